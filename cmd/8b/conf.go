@@ -17,6 +17,8 @@ var DefaultConfig []byte
 
 func readConf(reader io.Reader) (conf.Configuration, error) {
 	var config conf.Configuration
+	signinRateSet := false
+	graceSet := false
 
 	scanner := bufio.NewScanner(reader)
 
@@ -54,7 +56,14 @@ func readConf(reader io.Reader) (conf.Configuration, error) {
 		case "user_agent":
 			config.UserAgent = val
 		case "database_path":
-			// ignore
+			config.DatabasePath = val
+		case "session_store":
+			switch val {
+			case "memory", "file":
+				config.SessionStore = val
+			default:
+				return config, errors.New("session_store must be memory or file")
+			}
 		case "post_formats":
 			vals := strings.Split(val, ",")
 			var formats []conf.PostFormat
@@ -106,6 +115,130 @@ func readConf(reader io.Reader) (conf.Configuration, error) {
 
 				config.ResponseLimit = int64(i)
 			}
+		case "max_page_size":
+			if val != "" {
+				i, err := strconv.Atoi(val)
+				if err != nil || i < 1 {
+					return config, errors.New("max_page_size is not a positive number")
+				}
+
+				config.MaxPageSize = i
+			}
+		case "session_key":
+			config.SessionKey = val
+		case "session_key_previous":
+			for _, v := range strings.Split(val, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					config.SessionKeysPrevious = append(config.SessionKeysPrevious, v)
+				}
+			}
+		case "session_key_grace":
+			if val != "" {
+				var err error
+
+				config.SessionKeyGrace, err = time.ParseDuration(val)
+				if err != nil {
+					return config, err
+				}
+
+				if config.SessionKeyGrace < 0 {
+					return config, errors.New("session_key_grace cannot be negative")
+				}
+
+				graceSet = true
+			}
+		case "session_key_rotated":
+			if val != "" {
+				var err error
+
+				config.SessionKeyRotated, err = time.Parse(time.RFC3339, val)
+				if err != nil {
+					return config, errors.New("session_key_rotated must be a time such as 2024-03-01T12:00:00Z")
+				}
+			}
+		case "media_proxy":
+			switch val {
+			case "true":
+				config.MediaProxy = true
+			case "false", "":
+				config.MediaProxy = false
+			default:
+				return config, errors.New("media_proxy must be true or false")
+			}
+		case "media_cache_age":
+			if val != "" {
+				var err error
+
+				config.MediaCacheAge, err = time.ParseDuration(val)
+				if err != nil {
+					return config, err
+				}
+
+				if config.MediaCacheAge < 0 {
+					return config, errors.New("media_cache_age cannot be negative")
+				}
+			}
+		case "log_level":
+			if err := config.LogLevel.UnmarshalText([]byte(val)); err != nil {
+				return config, errors.New("log_level must be debug, info, warn or error")
+			}
+		case "log_format":
+			switch val {
+			case "text", "json":
+				config.LogFormat = val
+			default:
+				return config, errors.New("log_format must be text or json")
+			}
+		case "metrics":
+			switch val {
+			case "true":
+				config.Metrics = true
+			case "false", "":
+				config.Metrics = false
+			default:
+				return config, errors.New("metrics must be true or false")
+			}
+		case "metrics_token":
+			config.MetricsToken = val
+		case "ip_rate_limit", "session_rate_limit", "signin_rate_limit":
+			r, err := parseRateLimit(val)
+			if err != nil {
+				return config, errors.New(key + ": " + err.Error())
+			}
+
+			switch key {
+			case "ip_rate_limit":
+				config.IPRateLimit = r
+			case "session_rate_limit":
+				config.SessionRateLimit = r
+			case "signin_rate_limit":
+				config.SigninRateLimit = r
+				signinRateSet = true
+			}
+		case "real_ip_header":
+			config.RealIPHeader = val
+		case "real_ip_trusted_hops":
+			if val != "" {
+				i, err := strconv.Atoi(val)
+				if err != nil || i < 0 {
+					return config, errors.New("real_ip_trusted_hops cannot be negative")
+				}
+
+				config.RealIPTrustedHops = i
+			}
+		case "instance_allow", "instance_deny":
+			var instances []string
+			for _, v := range strings.Split(val, ",") {
+				if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+					instances = append(instances, v)
+				}
+			}
+
+			if key == "instance_allow" {
+				config.InstanceAllow = instances
+			} else {
+				config.InstanceDeny = instances
+			}
 		default:
 			return config, errors.New("unknown config key " + key)
 		}
@@ -123,5 +256,73 @@ func readConf(reader io.Reader) (conf.Configuration, error) {
 		config.ResponseLimit = (1 << (10 * 2)) * 8 // 8MB
 	}
 
+	if config.MaxPageSize == 0 {
+		config.MaxPageSize = 40
+	}
+
+	if config.LogFormat == "" {
+		config.LogFormat = "text"
+	}
+
+	if config.SessionStore == "" {
+		config.SessionStore = "memory"
+	}
+
+	if config.SessionStore == "file" && config.DatabasePath == "" {
+		return config, errors.New("session_store=file requires database_path")
+	}
+
+	if config.MediaProxy && config.DatabasePath == "" {
+		return config, errors.New("media_proxy requires database_path")
+	}
+
+	if int64(config.MediaCacheAge) == 0 {
+		config.MediaCacheAge = time.Hour * 24 * 7
+	}
+
+	if !graceSet {
+		config.SessionKeyGrace = time.Hour * 24 * 7
+	}
+
+	if len(config.SessionKeysPrevious) > 0 && config.SessionKeyRotated.IsZero() {
+		return config, errors.New("session_key_previous requires session_key_rotated")
+	}
+
+	if !signinRateSet {
+		config.SigninRateLimit = conf.RateLimit{Count: 10, Per: time.Hour}
+	}
+
 	return config, nil
 }
+
+// parseRateLimit parses limits written as count/duration, such as 120/1m.
+// An empty value means no limit, a count of 0 is an error rather than
+// another way to write it.
+func parseRateLimit(val string) (conf.RateLimit, error) {
+	if val == "" {
+		return conf.RateLimit{}, nil
+	}
+
+	count, per, ok := strings.Cut(val, "/")
+	if !ok {
+		return conf.RateLimit{}, errors.New("must be written as count/duration, such as 120/1m")
+	}
+
+	var r conf.RateLimit
+	var err error
+
+	r.Count, err = strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || r.Count <= 0 {
+		return r, errors.New("count is not a positive number")
+	}
+
+	r.Per, err = time.ParseDuration(strings.TrimSpace(per))
+	if err != nil {
+		return r, err
+	}
+	if r.Per <= 0 {
+		return r, errors.New("duration must be positive")
+	}
+
+	return r, nil
+}
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"io/fs"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"spiderden.org/8bloat/internal/conf"
@@ -73,10 +74,12 @@ func main() {
 		}
 	}
 
+	setLogger(cfg)
+
 	ctx, ctxf := context.WithCancel(context.Background())
 	errch := make(chan error)
 
-	log.Println("starting service on", cfg.ListenAddress)
+	slog.Info("starting service", "address", cfg.ListenAddress)
 	serv := &service.Service{}
 
 	go func() {
@@ -92,28 +95,29 @@ func main() {
 			switch sig {
 			case syscall.SIGHUP:
 				if *file == "-" {
-					log.Println("recieved sighup, but config is from stdin and cannot be reloaded")
+					slog.Warn("recieved sighup, but config is from stdin and cannot be reloaded")
 					continue
 				}
 
 				f, err := os.Open(*file)
 				if err != nil {
-					log.Println("recieved sighup, error while opening config file:", err)
+					slog.Error("recieved sighup, error while opening config file", "err", err)
 					continue
 				}
 
 				cfg, err := readConf(f)
 				f.Close()
 				if err != nil {
-					log.Println("recieved sighup, error while parsing and applying config:", err)
+					slog.Error("recieved sighup, error while parsing and applying config", "err", err)
 					continue
 				}
 
+				setLogger(cfg)
 				serv.ReplaceConfig(cfg)
 
-				log.Println("recieved sighup, reloaded config")
+				slog.Info("recieved sighup, reloaded config")
 			case os.Interrupt:
-				log.Println("got signal to terminate, gracefully stopping")
+				slog.Info("got signal to terminate, gracefully stopping")
 				ctxf()
 				<-errch
 				os.Exit(0)
@@ -123,3 +127,18 @@ func main() {
 		}
 	}
 }
+
+// setLogger makes the default logger, which the log package also writes
+// through, follow the configured level and format.
+func setLogger(cfg conf.Configuration) {
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+
+	var h slog.Handler
+	if cfg.LogFormat == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	slog.SetDefault(slog.New(h))
+}
@@ -3,7 +3,9 @@ module spiderden.org/8bloat
 require (
 	github.com/bwmarrin/snowflake v0.3.0
 	github.com/julienschmidt/httprouter v1.3.0
+	golang.org/x/image v0.18.0
 	golang.org/x/net v0.22.0
+	golang.org/x/sync v0.7.0
 	spiderden.org/masta v0.0.0-20240323013901-72a9d5d3e948
 )
 
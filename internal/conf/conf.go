@@ -5,6 +5,7 @@ package conf
 
 import (
 	_ "embed"
+	"log/slog"
 	"net/http"
 	"runtime/debug"
 	"time"
@@ -64,6 +65,41 @@ type Configuration struct {
 	ResponseLimit  int64
 	RequestTimeout time.Duration
 	Node           int64
+	MaxPageSize    int
+
+	SessionStore        string
+	DatabasePath        string
+	SessionKey          string
+	SessionKeysPrevious []string
+	SessionKeyGrace     time.Duration
+	SessionKeyRotated   time.Time
+
+	MediaProxy    bool
+	MediaCacheAge time.Duration
+
+	LogLevel     slog.Level
+	LogFormat    string
+	Metrics      bool
+	MetricsToken string
+
+	IPRateLimit       RateLimit
+	SessionRateLimit  RateLimit
+	SigninRateLimit   RateLimit
+	RealIPHeader      string
+	RealIPTrustedHops int
+	InstanceAllow     []string
+	InstanceDeny      []string
+}
+
+// RateLimit allows Count requests every Per, in bursts of up to Count.
+// The zero value doesn't limit anything.
+type RateLimit struct {
+	Count int
+	Per   time.Duration
+}
+
+func (r RateLimit) Enabled() bool {
+	return r.Count > 0 && r.Per > 0
 }
 
 func (c Configuration) SingleInstance() (instance string, ok bool) {
@@ -2,6 +2,6 @@ package conf
 
 // TODO: Make these configurable.
 const (
-	MaxPagination = 20
-	DefaultTheme  = "slate"
+	DefaultPageSize = 20
+	DefaultTheme    = "slate"
 )
@@ -2,36 +2,44 @@ package render
 
 import (
 	"io"
+	"regexp"
 	"spiderden.org/8bloat/internal/conf"
+	"spiderden.org/8bloat/internal/upstream"
 	"strings"
+	"time"
 
 	"spiderden.org/masta"
 )
 
 type Context struct {
-	Settings   Settings
-	CSRFToken  string
-	UserID     string
-	Referrer   string
-	W          io.Writer
-	Pagination *masta.Pagination
-	Conf       *conf.Configuration
-
-	next            string
+	Settings  Settings
+	CSRFToken string
+	UserID    string
+	Referrer  string
+	W         io.Writer
+	Conf      *conf.Configuration
+	Caps      upstream.Caps
+	Quotes    *upstream.Quotes
+	Filtered  *upstream.Filtered
+	Proxy     MediaProxy
+
+	// Filters are matched against statuses here on instances without
+	// filters v2, which don't say what their filters matched.
+	Filters []*upstream.Filter
+
 	refreshInterval int
 	count           int
 	target          string
 	title           string
+	filterContext   string
+	focus           string
+	matchers        []*regexp.Regexp
 }
 
 func (c *Context) RefreshInterval() int {
 	return c.refreshInterval
 }
 
-func (c *Context) Next() string {
-	return c.next
-}
-
 func (c *Context) Count() int {
 	return c.count
 }
@@ -44,17 +52,37 @@ func (c *Context) Title() string {
 	return c.title
 }
 
+// Pager links to the pages before and after a list. Either is empty when
+// there's no such page.
+type Pager struct {
+	PrevLink string
+	NextLink string
+}
+
 type NavData struct {
 	Context     *Context
 	User        *masta.Account
+	Accounts    []AccountData
 	PostContext PostContext
 }
 
+type AccountData struct {
+	ID       string
+	Acct     string
+	Instance string
+	Active   bool
+}
+
+type AccountsData struct {
+	Accounts []AccountData
+}
+
 type ErrorData struct {
 	*Context
 	Err        string
 	Retry      bool
 	SessionErr bool
+	DraftSaved bool
 }
 
 type HomePageData struct {
@@ -75,8 +103,19 @@ type TimelineData struct {
 	Type     string
 	Instance string
 	Statuses []*masta.Status
-	NextLink string
-	PrevLink string
+	Pager
+
+	// Tag is set for hashtag timelines, Only is which part of it is
+	// shown.
+	Tag  *upstream.Tag
+	Only string
+
+	// Hidden is how many statuses the user's rules left out.
+	Hidden []RuleCount
+}
+
+type TagsData struct {
+	Tags []*upstream.Tag
 }
 
 type ListsData struct {
@@ -89,13 +128,29 @@ type ListData struct {
 	Accounts       []*masta.Account
 	Q              string
 	SearchAccounts []*masta.Account
+	Pager
 }
 
 type ThreadData struct {
 	Statuses    []*StatusData
+	Tree        []*ThreadNode
 	PostContext PostContext
 }
 
+type ThreadNode struct {
+	Status      *StatusData
+	Children    []*ThreadNode
+	Depth       int
+	Descendants int
+	Focused     bool
+	// Flat is set once the depth limit is reached, so the children
+	// aren't indented any further.
+	Flat bool
+	// ReplyForm is the reply or quote form shown under the status.
+	ReplyForm *PostContext
+	EditForm  *PostContext
+}
+
 type StatusData struct {
 	*masta.Status
 	No          *int
@@ -105,6 +160,24 @@ type StatusData struct {
 	History     bool
 }
 
+// QuoteData is a quoted status, shown inside the status quoting it. Depth
+// is 1 for the quote of a status, 2 for the quote of that quote, etc.
+type QuoteData struct {
+	Status *masta.Status
+	Depth  int
+}
+
+// Nested reports whether the quote of this status is shown too, or only
+// linked to.
+func (q *QuoteData) Nested() bool {
+	return q.Depth < quoteMaxDepth
+}
+
+// Next wraps the status quoted by this one.
+func (q *QuoteData) Next(s *masta.Status) *QuoteData {
+	return wrapQuote(s, q.Depth+1)
+}
+
 type ThreadReplyData struct {
 	No int
 	masta.ID
@@ -117,10 +190,66 @@ type QuickReplyData struct {
 }
 
 type NotificationData struct {
-	Notifications []*masta.Notification
+	Notifications []*NotificationGroup
 	UnmarkedCount int
 	ReadID        string
-	NextLink      string
+	Type          string
+	Pager
+}
+
+// NotificationGroup is a notification, along with the newer ones of the
+// same kind on the same status from other accounts, shown as one.
+type NotificationGroup struct {
+	*masta.Notification
+	Others []*masta.Notification
+}
+
+// Rest is how many others there are besides the first one named.
+func (g *NotificationGroup) Rest() int {
+	return max(len(g.Others)-1, 0)
+}
+
+// Unseen reports whether any of the notifications is unread.
+func (g *NotificationGroup) Unseen() bool {
+	if g.Pleroma != nil && !g.Pleroma.IsSeen {
+		return true
+	}
+	for _, v := range g.Others {
+		if v.Pleroma != nil && !v.Pleroma.IsSeen {
+			return true
+		}
+	}
+	return false
+}
+
+// OthersLink lists everyone who interacted with the status that way.
+func (g *NotificationGroup) OthersLink() string {
+	switch g.Type {
+	case "favourite":
+		return "/likedby/" + g.Status.ID
+	case "reblog":
+		return "/retweetedby/" + g.Status.ID
+	default:
+		return "/reactions/" + g.Status.ID
+	}
+}
+
+type FeedData struct {
+	Title   string
+	Link    string
+	Self    string
+	Entries []FeedEntry
+}
+
+type FeedEntry struct {
+	ID        string
+	Title     string
+	Link      string
+	Author    string
+	AuthorURI string
+	Published time.Time
+	Updated   time.Time
+	Content   string
 }
 
 type UserData struct {
@@ -130,14 +259,14 @@ type UserData struct {
 	Type         string
 	Users        []*masta.Account
 	Statuses     []*masta.Status
-	NextLink     string
+	Pager
 }
 
 type UserSearchData struct {
 	User     *masta.Account
 	Q        string
 	Statuses []*masta.Status
-	NextLink string
+	Pager
 }
 
 type EmojiData struct {
@@ -145,17 +274,19 @@ type EmojiData struct {
 }
 
 type LikedByData struct {
-	Users    []*masta.Account
-	NextLink string
+	Users []*masta.Account
+	Pager
 }
 
 type RetweetedByData struct {
-	Users    []*masta.Account
-	NextLink string
+	Users []*masta.Account
+	Pager
 }
 
 type ReactionsData struct {
-	Reactions []masta.EmojiReaction
+	ID        string
+	Reactions []*upstream.Reaction
+	Emojis    []*masta.Emoji
 }
 
 type SearchData struct {
@@ -163,16 +294,80 @@ type SearchData struct {
 	Type     string
 	Users    []*masta.Account
 	Statuses []*masta.Status
-	NextLink string
+	Pager
 }
 
 type SettingsData struct {
 	Settings    *Settings
 	PostFormats []conf.PostFormat
+	FeedToken   string
+	MaxPageSize int
+}
+
+type DraftData struct {
+	ID         string
+	ReplyToID  string
+	EditID     string
+	QuoteID    string
+	MediaIDs   []string
+	Visibility string
+	Format     string
+	Subject    string
+	Content    string
+	Saved      time.Time
+}
+
+type DraftsData struct {
+	Drafts []DraftData
+}
+
+type DraftPageData struct {
+	PostContext PostContext
+}
+
+type ScheduledData struct {
+	Statuses []ScheduledStatusData
+	Location string
+}
+
+type ScheduledStatusData struct {
+	*upstream.ScheduledStatus
+	Local string
+	Time  string
 }
 
 type FiltersData struct {
-	Filters []*masta.Filter
+	Filters  []*upstream.Filter
+	Contexts []string
+}
+
+type RulesData struct {
+	Rules []Rule
+	Kinds []string
+	Lists []*masta.List
+}
+
+// TimelineName is how the timeline of a rule is shown.
+func (d *RulesData) TimelineName(timeline string) string {
+	if id, ok := strings.CutPrefix(timeline, "list/"); ok {
+		for _, v := range d.Lists {
+			if v.ID == id {
+				return "list " + v.Title
+			}
+		}
+		return "a removed list"
+	}
+	return timelineNames[timeline]
+}
+
+var timelineNames = map[string]string{
+	"":       "all timelines",
+	"home":   "home",
+	"direct": "direct",
+	"local":  "local",
+	"remote": "remote",
+	"twkn":   "the whole known network",
+	"tag":    "hashtags",
 }
 
 type MuteData struct {
@@ -184,8 +379,9 @@ type PostContext struct {
 	DefaultFormat     string
 	ReplyContext      *ReplyContext
 	EditContext       *EditContext
+	QuoteContext      *QuoteContext
+	DraftContext      *DraftData
 	Formats           []conf.PostFormat
-	Pleroma           bool
 }
 
 type ProfileData struct {
@@ -206,6 +402,11 @@ type ReplyContext struct {
 	ForceVisibility    bool
 }
 
+type QuoteContext struct {
+	QuoteID   string
+	QuoteName string
+}
+
 func (r *ReplyContext) ReifiedSubjectHeader() string {
 	sh := r.ReplySubjectHeader
 	if (sh != "") && (!strings.HasPrefix(sh, "re: ")) {
@@ -229,9 +430,23 @@ type Settings struct {
 	HideUnsupportedNotifs bool              `json:"hun,omitempty"`
 	CSS                   string            `json:"css,omitempty"`
 	ThemeCSS              map[string]string `json:"theme_css,omitempty"`
+	ThreadTree            bool              `json:"tt,omitempty"`
+	TimeZone              string            `json:"tz,omitempty"`
+	PageSize              int               `json:"ps,omitempty"`
+	Rules                 []Rule            `json:"rules,omitempty"`
 	Stamp                 string            `json:"stamp,omitempty"`
 }
 
+// Location returns the time zone used to read and show times the user
+// picks, such as when a post is scheduled.
+func (s Settings) Location() *time.Location {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
 func NewSettings() *Settings {
 	return &Settings{
 		DefaultVisibility:     "public",
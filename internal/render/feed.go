@@ -0,0 +1,273 @@
+package render
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"time"
+
+	"spiderden.org/masta"
+)
+
+const (
+	FeedAtom = "atom"
+	FeedRSS  = "rss"
+)
+
+// FeedContentType returns the content type for the given feed format.
+func FeedContentType(format string) string {
+	if format == FeedRSS {
+		return "application/rss+xml; charset=utf-8"
+	}
+	return "application/atom+xml; charset=utf-8"
+}
+
+// absLinks rewrites the local links added by statusContentFilter, since
+// feed readers resolve them against the feed, not the frame.
+func absLinks(base string, content string) string {
+	return strings.ReplaceAll(content, `href="/`, `href="`+base+`/`)
+}
+
+func statusContent(base string, s *masta.Status) string {
+	content := absLinks(base, statusContentFilter(s.Content, s.Emojis, s.Mentions, nil))
+	if s.SpoilerText != "" {
+		content = "<p><strong>" + escape(s.SpoilerText) + "</strong></p>" + content
+	}
+
+	for _, a := range s.MediaAttachments {
+		desc := a.Description
+		if desc == "" {
+			desc = a.Type
+		}
+		content += `<p><a href="` + escape(a.URL) + `">` + escape(desc) + `</a></p>`
+	}
+
+	return content
+}
+
+func displayName(a *masta.Account) string {
+	if a.DisplayName != "" {
+		return a.DisplayName
+	}
+	return a.Username
+}
+
+// StatusEntry turns a status into a feed entry. Links point back to
+// 8bloat at base, rather than to the remote instance.
+func StatusEntry(base string, s *masta.Status) FeedEntry {
+	e := FeedEntry{
+		ID:        s.URI,
+		Link:      base + "/thread/" + s.ID,
+		Published: s.CreatedAt,
+		Updated:   s.CreatedAt,
+	}
+
+	if !s.EditedAt.IsZero() {
+		e.Updated = s.EditedAt
+	}
+
+	c := s
+	if s.Reblog != nil {
+		c = s.Reblog
+		e.Title = displayName(&s.Account) + " retweeted " + displayName(&c.Account)
+		e.Link = base + "/thread/" + c.ID
+	} else {
+		e.Title = displayName(&s.Account)
+	}
+
+	if e.ID == "" {
+		e.ID = e.Link
+	}
+
+	e.Author = "@" + c.Account.Acct
+	e.AuthorURI = base + "/user/" + c.Account.ID
+	e.Content = statusContent(base, c)
+	return e
+}
+
+// NotificationEntry turns a notification into a feed entry.
+func NotificationEntry(base string, n *masta.Notification) FeedEntry {
+	e := FeedEntry{
+		ID:        base + "/notifications#" + n.ID,
+		Link:      base + "/user/" + n.Account.ID,
+		Author:    "@" + n.Account.Acct,
+		AuthorURI: base + "/user/" + n.Account.ID,
+		Published: n.CreatedAt,
+		Updated:   n.CreatedAt,
+	}
+
+	name := displayName(&n.Account)
+	switch n.Type {
+	case "mention":
+		e.Title = name + " mentioned you"
+	case "reblog":
+		e.Title = name + " retweeted your post"
+	case "favourite":
+		e.Title = name + " liked your post"
+	case "follow":
+		e.Title = name + " followed you"
+	case "follow_request":
+		e.Title = name + " wants to follow you"
+	case "pleroma:emoji_reaction":
+		e.Title = name + " reacted with " + n.Emoji
+	case "status":
+		e.Title = name + " posted"
+	case "poll":
+		e.Title = "A poll has ended"
+	case "update":
+		e.Title = name + " edited a post"
+	default:
+		e.Title = name + " " + n.Type
+	}
+
+	if n.Status != nil {
+		e.Link = base + "/thread/" + n.Status.ID
+		e.Content = statusContent(base, n.Status)
+	}
+
+	return e
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Link      atomLink   `xml:"link"`
+	Author    atomPerson `xml:"author"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Content   *atomText  `xml:"content,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Body        string `xml:",chardata"`
+}
+
+type rssItem struct {
+	GUID        rssGUID `xml:"guid"`
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description,omitempty"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+func FeedPage(rctx *Context, format string, data *FeedData) (err error) {
+	var v interface{}
+	if format == FeedRSS {
+		v = rssFeed(data)
+	} else {
+		v = atomFeedOf(data)
+	}
+
+	if _, err = io.WriteString(rctx.W, xml.Header); err != nil {
+		return
+	}
+
+	enc := xml.NewEncoder(rctx.W)
+	enc.Indent("", "\t")
+	return enc.Encode(v)
+}
+
+func atomFeedOf(data *FeedData) *atomFeed {
+	// Entries are newest first, so the feed was last updated by the
+	// first one.
+	updated := time.Now()
+	if len(data.Entries) > 0 {
+		updated = data.Entries[0].Updated
+	}
+
+	f := &atomFeed{
+		ID:      data.Self,
+		Title:   data.Title,
+		Updated: updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "alternate", Href: data.Link},
+			{Rel: "self", Href: data.Self},
+		},
+	}
+
+	for _, e := range data.Entries {
+		ae := atomEntry{
+			ID:        e.ID,
+			Title:     e.Title,
+			Link:      atomLink{Rel: "alternate", Href: e.Link},
+			Author:    atomPerson{Name: e.Author, URI: e.AuthorURI},
+			Published: e.Published.Format(time.RFC3339),
+			Updated:   e.Updated.Format(time.RFC3339),
+		}
+
+		if e.Content != "" {
+			ae.Content = &atomText{Type: "html", Body: e.Content}
+		}
+
+		f.Entries = append(f.Entries, ae)
+	}
+
+	return f
+}
+
+func rssFeed(data *FeedData) *rss {
+	f := &rss{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       data.Title,
+			Link:        data.Link,
+			Description: data.Title,
+		},
+	}
+
+	for _, e := range data.Entries {
+		f.Channel.Items = append(f.Channel.Items, rssItem{
+			GUID:        rssGUID{IsPermaLink: "false", Body: e.ID},
+			Title:       e.Title,
+			Link:        e.Link,
+			PubDate:     e.Published.Format(time.RFC1123Z),
+			Description: e.Content,
+		})
+	}
+
+	return f
+}
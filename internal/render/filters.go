@@ -0,0 +1,149 @@
+package render
+
+import (
+	"regexp"
+	"slices"
+	"spiderden.org/8bloat/internal/upstream"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"spiderden.org/masta"
+)
+
+// FilterResult is what the user's filters do to a status. Warning has the
+// titles of the filters it only warns about.
+type FilterResult struct {
+	Hide    bool
+	Warning string
+}
+
+// FilterStatus applies the filters matched by a status in the context of
+// the page. Instances with filters v2 say which filters matched, older
+// ones are left to the client. Edits aren't filtered, nor is the status a
+// thread is about, which is only ever warned about.
+func (c *Context) FilterStatus(s StatusData) FilterResult {
+	var res FilterResult
+	if c.filterContext == "" || s.Status == nil || s.History {
+		return res
+	}
+
+	var titles []string
+	for _, f := range c.statusFilters(s.Status) {
+		if !f.Applies(c.filterContext) {
+			continue
+		}
+		if f.Action == upstream.FilterHide && s.ID != c.focus {
+			res.Hide = true
+			return res
+		}
+		if !slices.Contains(titles, f.Title) {
+			titles = append(titles, f.Title)
+		}
+	}
+
+	res.Warning = strings.Join(titles, ", ")
+	return res
+}
+
+func (c *Context) statusFilters(s *masta.Status) []*upstream.Filter {
+	filters := c.Filtered.Get(s.ID)
+	if s.Reblog != nil {
+		filters = append(filters, c.Filtered.Get(s.Reblog.ID)...)
+	}
+	if len(c.Filters) == 0 {
+		return filters
+	}
+
+	if c.matchers == nil {
+		c.matchers = compileFilters(c.Filters)
+	}
+	if s.Reblog != nil {
+		s = s.Reblog
+	}
+	text := filterText(s)
+	for i, re := range c.matchers {
+		if re.MatchString(text) {
+			filters = append(filters, c.Filters[i])
+		}
+	}
+	return filters
+}
+
+// compileFilters matches any of the keywords of each filter. Whole words
+// are only bounded on the sides that start or end with a word character,
+// the way Mastodon matches them.
+func compileFilters(filters []*upstream.Filter) []*regexp.Regexp {
+	matchers := make([]*regexp.Regexp, 0, len(filters))
+	for _, f := range filters {
+		var alts []string
+		for _, k := range f.Keywords {
+			if k.Keyword == "" {
+				continue
+			}
+			expr := regexp.QuoteMeta(k.Keyword)
+			if k.WholeWord {
+				if isWordByte(k.Keyword[0]) {
+					expr = `\b` + expr
+				}
+				if isWordByte(k.Keyword[len(k.Keyword)-1]) {
+					expr += `\b`
+				}
+			}
+			alts = append(alts, expr)
+		}
+
+		// A filter without keywords matches nothing.
+		expr := `$.^`
+		if len(alts) > 0 {
+			expr = `(?i)(?:` + strings.Join(alts, "|") + `)`
+		}
+		matchers = append(matchers, regexp.MustCompile(expr))
+	}
+	return matchers
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// filterText is the text of a status that filters are matched against,
+// one part per line so that words don't run into each other.
+func filterText(s *masta.Status) string {
+	parts := []string{s.SpoilerText, plainText(s.Content)}
+	for _, v := range s.MediaAttachments {
+		parts = append(parts, v.Description)
+	}
+	if s.Poll != nil {
+		for _, v := range s.Poll.Options {
+			parts = append(parts, v.Title)
+		}
+	}
+	parts = slices.DeleteFunc(parts, func(p string) bool { return p == "" })
+	return strings.Join(parts, "\n")
+}
+
+// plainText returns the text of HTML content, with its paragraphs and
+// line breaks as newlines.
+func plainText(content string) string {
+	node, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return content
+	}
+
+	var text strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			text.WriteString(n.Data)
+		case n.Type == html.ElementNode && (n.Data == "p" || n.Data == "br"):
+			text.WriteByte('\n')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(node)
+	return strings.TrimSpace(text.String())
+}
@@ -0,0 +1,43 @@
+package render
+
+import (
+	"spiderden.org/masta"
+)
+
+// MediaProxy rewrites the URLs of remote media, so that they are loaded
+// through 8bloat rather than straight from other instances.
+type MediaProxy interface {
+	// URL returns the proxied URL of u. If height isn't 0, images are
+	// scaled down to that many pixels high.
+	URL(u string, height int) string
+}
+
+// Media returns the URL that the media at u should be loaded from.
+func (c *Context) Media(u string) string {
+	return proxyURL(c.Proxy, u)
+}
+
+// Thumb is like Media, but the image is scaled down to the height it's
+// shown at if it's proxied. The height is doubled, for high density
+// screens.
+func (c *Context) Thumb(u string, height int) string {
+	if c.Proxy == nil || u == "" {
+		return u
+	}
+	return c.Proxy.URL(u, height*2)
+}
+
+func (c *Context) EmojiFilter(content string, emojis []masta.Emoji) string {
+	return emojiFilter(content, emojis, c.Proxy)
+}
+
+func (c *Context) StatusContentFilter(content string, emojis []masta.Emoji, mentions []masta.Mention) string {
+	return statusContentFilter(content, emojis, mentions, c.Proxy)
+}
+
+func proxyURL(p MediaProxy, u string) string {
+	if p == nil || u == "" {
+		return u
+	}
+	return p.URL(u, 0)
+}
@@ -1,15 +1,38 @@
 package render
 
 import (
-	"fmt"
+	"errors"
+	"math"
 	"net/http"
+	"slices"
 	"spiderden.org/8bloat/internal/conf"
+	"spiderden.org/8bloat/internal/upstream"
+	"strconv"
 	"strings"
 	"time"
 
 	"spiderden.org/masta"
 )
 
+// ErrDraftSaved is wrapped into errors when the post form was saved as
+// a draft before showing the error page.
+var ErrDraftSaved = errors.New("saved to drafts")
+
+// RateLimitError is returned when a client made too many requests. The
+// error page is sent with a 429 status, telling the client when to try
+// again.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return "too many requests, try again in " + retrySeconds(e.RetryAfter) + "s"
+}
+
+func retrySeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
 const (
 	SigninPageTmpl       = "signin.tmpl"
 	ErrorPageTmpl        = "error.tmpl"
@@ -34,6 +57,12 @@ const (
 	MutePageTmpl         = "mute.tmpl"
 	StatusEditsTmpl      = "statusedits.tmpl"
 	ProfilePageTmpl      = "editprofile.tmpl"
+	AccountsPageTmpl     = "accounts.tmpl"
+	ScheduledPageTmpl    = "scheduled.tmpl"
+	DraftsPageTmpl       = "drafts.tmpl"
+	DraftPageTmpl        = "draft.tmpl"
+	TagsPageTmpl         = "tags.tmpl"
+	RulesPageTmpl        = "rules.tmpl"
 )
 
 func SigninPage(rctx *Context) error {
@@ -53,16 +82,21 @@ func ListPage(rctx *Context, data *ListData) error {
 	return render(rctx, ListPageTmpl, data)
 }
 
-func NavPage(rctx *Context, user *masta.Account) (err error) {
+func TagsPage(rctx *Context, tags []*upstream.Tag) error {
+	rctx.title = "hashtags // 8bloat"
+	return render(rctx, TagsPageTmpl, &TagsData{Tags: tags})
+}
+
+func NavPage(rctx *Context, user *masta.Account, accounts []AccountData) (err error) {
 	rctx.target = "main"
 
 	return render(rctx, NavPageTmpl, &NavData{
-		User: user,
+		User:     user,
+		Accounts: accounts,
 		PostContext: PostContext{
-			Formats:           rctx.Conf.PostFormats,
+			Formats:           postFormats(rctx),
 			DefaultFormat:     rctx.Settings.DefaultFormat,
 			DefaultVisibility: rctx.Settings.DefaultVisibility,
-			Pleroma:           user.Pleroma != nil,
 		},
 	})
 }
@@ -73,29 +107,52 @@ func RootPage(rctx *Context) (err error) {
 	return render(rctx, RootPageTmpl, rctx)
 }
 
+// postFormats returns the configured post formats that the instance
+// accepts.
+func postFormats(rctx *Context) []conf.PostFormat {
+	var formats []conf.PostFormat
+	for _, v := range rctx.Conf.PostFormats {
+		if rctx.Caps.SupportsContentType(v.Type) {
+			formats = append(formats, v)
+		}
+	}
+	return formats
+}
+
 func ProfilePage(rctx *Context, acct *masta.Account) (err error) {
 	rctx.title = "edit profile // 8bloat"
 	return render(rctx, ProfilePageTmpl, ProfileData{User: acct})
 }
 
-func ThreadPage(rctx *Context, status *masta.Status, context *masta.Context, mutate bool, src *masta.Source) (err error) {
+func ThreadPage(rctx *Context, status *masta.Status, context *masta.Context, mutate bool, quote bool, src *masta.Source) (err error) {
 	rctx.title = "thread // 8bloat"
+	rctx.filterContext = "thread"
+	rctx.focus = status.ID
 
 	var pctx PostContext
 
 	// If we are mutating, and there is no source status, then
-	// it is a reply.
+	// it is a reply, unless it's a quote.
 	if mutate && src != nil {
 		pctx = PostContext{
 			DefaultVisibility: status.Visibility,
 			DefaultFormat:     rctx.Settings.DefaultFormat,
-			Formats:           rctx.Conf.PostFormats,
-			Pleroma:           status.Pleroma != nil,
+			Formats:           postFormats(rctx),
 			EditContext: &EditContext{
 				Source: src,
 				Status: status,
 			},
 		}
+	} else if mutate && quote {
+		pctx = PostContext{
+			DefaultVisibility: rctx.Settings.DefaultVisibility,
+			DefaultFormat:     rctx.Settings.DefaultFormat,
+			Formats:           postFormats(rctx),
+			QuoteContext: &QuoteContext{
+				QuoteID:   status.ID,
+				QuoteName: status.Account.Acct,
+			},
+		}
 	} else if mutate {
 		var content string
 		var visibility string
@@ -119,8 +176,7 @@ func ThreadPage(rctx *Context, status *masta.Status, context *masta.Context, mut
 		pctx = PostContext{
 			DefaultVisibility: visibility,
 			DefaultFormat:     rctx.Settings.DefaultFormat,
-			Formats:           rctx.Conf.PostFormats,
-			Pleroma:           status.Pleroma != nil,
+			Formats:           postFormats(rctx),
 			ReplyContext: &ReplyContext{
 				InReplyToID:        status.ID,
 				InReplyToName:      status.Account.Acct,
@@ -182,17 +238,88 @@ func ThreadPage(rctx *Context, status *masta.Status, context *masta.Context, mut
 		PostContext: pctx,
 	}
 
+	if rctx.Settings.ThreadTree {
+		data.Tree = threadTree(statusdata, status.ID, &data.PostContext)
+	}
+
 	return render(rctx, ThreadPageTmpl, data)
 }
 
+// threadMaxDepth is how deep replies are indented in the tree view,
+// deeper replies are shown at that depth.
+const threadMaxDepth = 8
+
+// threadTree nests the statuses by what they reply to. Statuses whose
+// parent isn't in the thread become roots, so nothing is dropped.
+func threadTree(statuses []*StatusData, focus masta.ID, pctx *PostContext) []*ThreadNode {
+	nodes := make(map[masta.ID]*ThreadNode, len(statuses))
+	for _, v := range statuses {
+		node := &ThreadNode{
+			Status:  v,
+			Focused: v.ID == focus,
+		}
+
+		switch {
+		case pctx.EditContext != nil && pctx.EditContext.Status.ID == v.ID:
+			node.EditForm = pctx
+		case pctx.ReplyContext != nil && pctx.ReplyContext.InReplyToID == v.ID:
+			node.ReplyForm = pctx
+		case pctx.QuoteContext != nil && pctx.QuoteContext.QuoteID == v.ID:
+			node.ReplyForm = pctx
+		}
+
+		nodes[v.ID] = node
+	}
+
+	var roots []*ThreadNode
+	for _, v := range statuses {
+		node := nodes[v.ID]
+		if v.InReplyToID != nil {
+			if parent, ok := nodes[*v.InReplyToID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+
+	var walk func(nodes []*ThreadNode, depth int) int
+	walk = func(nodes []*ThreadNode, depth int) (count int) {
+		for _, v := range nodes {
+			v.Depth = depth
+			v.Flat = depth >= threadMaxDepth
+			v.Descendants = walk(v.Children, depth+1)
+			count += v.Descendants + 1
+		}
+		return
+	}
+	walk(roots, 0)
+
+	return roots
+}
+
 // We don't abstract this stuff away that much because
 // there's too many transport-level details and too little
 // data reshuffling for the templating.
 func TimelinePage(rctx *Context, data *TimelineData) error {
 	rctx.title = strings.ToLower(data.Title) + " // 8bloat"
+	rctx.filterContext = timelineFilterContext(data.Type)
 	return render(rctx, TimelinePageTmpl, data)
 }
 
+// timelineFilterContext is the filter context of a timeline. Direct
+// messages aren't filtered.
+func timelineFilterContext(timeline string) string {
+	switch timeline {
+	case "home", "list":
+		return "home"
+	case "direct":
+		return ""
+	default:
+		return "public"
+	}
+}
+
 func QuickReplyPage(rctx *Context, replyee *masta.Status, parent *masta.Status) (err error) {
 	rctx.title = "quickreply // 8bloat"
 	var content string
@@ -216,7 +343,7 @@ func QuickReplyPage(rctx *Context, replyee *masta.Status, parent *masta.Status)
 	pctx := PostContext{
 		DefaultVisibility: visibility,
 		DefaultFormat:     rctx.Settings.DefaultFormat,
-		Formats:           rctx.Conf.PostFormats,
+		Formats:           postFormats(rctx),
 		ReplyContext: &ReplyContext{
 			InReplyToID:        replyee.ID,
 			InReplyToName:      replyee.Account.Acct,
@@ -235,26 +362,30 @@ func QuickReplyPage(rctx *Context, replyee *masta.Status, parent *masta.Status)
 	return render(rctx, QuickReplyPageTmpl, data)
 }
 
-func LikedByPage(rctx *Context, likers []*masta.Account) (err error) {
+func LikedByPage(rctx *Context, likers []*masta.Account, pager Pager) (err error) {
 	rctx.title = "post likes // 8bloat"
 	data := &LikedByData{
 		Users: likers,
+		Pager: pager,
 	}
 	return render(rctx, LikedByPageTmpl, data)
 }
 
-func RetweetedByPage(rctx *Context, retweeters []*masta.Account) (err error) {
+func RetweetedByPage(rctx *Context, retweeters []*masta.Account, pager Pager) (err error) {
 	rctx.title = "post retweets // 8bloat"
 	data := &RetweetedByData{
 		Users: retweeters,
+		Pager: pager,
 	}
 	return render(rctx, RetweetedByPageTmpl, data)
 }
 
-func ReactionsPage(rctx *Context, reactions []masta.EmojiReaction) (err error) {
+func ReactionsPage(rctx *Context, id string, reactions []*upstream.Reaction, emojis []*masta.Emoji) (err error) {
 	rctx.title = "post reactions // 8bloat"
 	data := &ReactionsData{
+		ID:        id,
 		Reactions: reactions,
+		Emojis:    emojis,
 	}
 
 	return render(rctx, ReactionsPageTmpl, data)
@@ -285,10 +416,13 @@ func EditsPage(rctx *Context, history []*masta.StatusHistory, current *masta.Sta
 	return render(rctx, StatusEditsTmpl, statuses)
 }
 
-func NotificationPage(rctx *Context, notifs []*masta.Notification) (err error) {
+func NotificationPage(rctx *Context, notifs []*masta.Notification, only string, pager Pager) (err error) {
 	rctx.title = "notifications // 8bloat"
+	rctx.filterContext = "notifications"
 	data := &NotificationData{
-		Notifications: notifs,
+		Notifications: groupNotifications(rctx.unfiltered(notifs)),
+		Type:          only,
+		Pager:         pager,
 	}
 
 	rctx.title = "8b | notifications"
@@ -306,11 +440,60 @@ func NotificationPage(rctx *Context, notifs []*masta.Notification) (err error) {
 		data.ReadID = notifs[0].ID
 	}
 
-	if len(notifs) >= conf.MaxPagination {
-		data.NextLink = "/notifications?max_id=" + notifs[len(notifs)-1].ID
+	return render(rctx, NotificationPageTmpl, data)
+}
+
+// unfiltered leaves out the notifications about statuses that the user's
+// filters hide.
+func (c *Context) unfiltered(notifs []*masta.Notification) []*masta.Notification {
+	return slices.DeleteFunc(slices.Clone(notifs), func(n *masta.Notification) bool {
+		return n != nil && n.Status != nil && c.FilterStatus(wrapRawStatus(n.Status)).Hide
+	})
+}
+
+// groupNotifications shows the likes, retweets and reactions on a status
+// as one notification, where the newest of them was. Only notifications
+// on the same page are grouped.
+func groupNotifications(notifs []*masta.Notification) []*NotificationGroup {
+	groups := make([]*NotificationGroup, 0, len(notifs))
+	byStatus := make(map[string]*NotificationGroup)
+
+	for _, n := range notifs {
+		if n == nil {
+			continue
+		}
+
+		switch n.Type {
+		case "favourite", "reblog", "pleroma:emoji_reaction":
+		default:
+			groups = append(groups, &NotificationGroup{Notification: n})
+			continue
+		}
+
+		if n.Status == nil {
+			groups = append(groups, &NotificationGroup{Notification: n})
+			continue
+		}
+
+		// Reactions are grouped by emoji too.
+		key := n.Type + "\x00" + n.Status.ID + "\x00" + n.Emoji
+		g, ok := byStatus[key]
+		if !ok {
+			g = &NotificationGroup{Notification: n}
+			byStatus[key] = g
+			groups = append(groups, g)
+			continue
+		}
+
+		if g.Account.ID == n.Account.ID || slices.ContainsFunc(g.Others, func(o *masta.Notification) bool {
+			return o.Account.ID == n.Account.ID
+		}) {
+			continue
+		}
+		g.Others = append(g.Others, n)
 	}
 
-	return render(rctx, NotificationPageTmpl, data)
+	return groups
 }
 
 type userPageEntry interface {
@@ -332,55 +515,42 @@ const (
 	UserPageRequests  userPageType = "requests"
 )
 
-func UserPage[up userPageEntry](rctx *Context, user *masta.Account, rel *masta.Relationship, pdata up, page userPageType) (err error) {
+func UserPage[up userPageEntry](rctx *Context, user *masta.Account, rel *masta.Relationship, pdata up, page userPageType, pager Pager) (err error) {
 	data := &UserData{
 		User:         user,
 		IsCurrent:    (user.ID == rctx.UserID),
 		Type:         string(page),
 		Relationship: rel,
+		Pager:        pager,
 	}
 
-	next := false
 	switch d := interface{}(pdata).(type) {
 	case []*masta.Status:
-		if int64(len(d)) == conf.MaxPagination {
-			next = true
-		}
 		data.Statuses = d
 	case []*masta.Account:
-		if int64(len(d)) == conf.MaxPagination {
-			next = true
-		}
 		data.Users = d
 	}
 
-	if pg := rctx.Pagination; next && (pg != nil) && pg.MaxID != "" {
-		var p string
-		if page != "statuses" {
-			p = "/" + string(page)
-		}
-		data.NextLink = fmt.Sprintf("/user/%s%s?max_id=%s", user.ID, p, pg.MaxID)
-	}
-
 	titleparen := ""
 	if page != UserPageStatuses {
 		titleparen = "(" + data.Type + ") "
 	}
 	rctx.title = "@" + user.Acct + " " + titleparen + "// 8bloat"
+	switch page {
+	case UserPageStatuses, UserPagePinned, UserPageMedia:
+		rctx.filterContext = "account"
+	}
 
 	return render(rctx, UserPageTmpl, data)
 }
 
-func UserSearchPage(rctx *Context, offset int, res *masta.Results, acct *masta.Account, query string) (err error) {
+func UserSearchPage(rctx *Context, res *masta.Results, acct *masta.Account, query string, pager Pager) (err error) {
 	rctx.title = "@" + acct.Acct + " (search) // 8bloat"
-	if len(res.Statuses) == conf.MaxPagination {
-		rctx.next = fmt.Sprintf("/usersearch/%s?q=%s&offset=%d", acct.ID, query, offset+conf.MaxPagination)
-	}
-
 	data := &UserSearchData{
 		User:     acct,
 		Q:        query,
 		Statuses: res.Statuses,
+		Pager:    pager,
 	}
 
 	return render(rctx, UserSearchPageTmpl, data)
@@ -405,39 +575,92 @@ func EmojiPage(rctx *Context, ems []*masta.Emoji) (err error) {
 	})
 }
 
-func SearchPage(rctx *Context, results *masta.Results, q string, qType string, offset int) (err error) {
+func SearchPage(rctx *Context, results *masta.Results, q string, qType string, pager Pager) (err error) {
 	rctx.title = "search // 8bloat"
-	var nextLink string
-
-	if (qType == "accounts" && len(results.Accounts) == 20) ||
-		(qType == "statuses" && len(results.Statuses) == 20) {
-		offset += 20
-		nextLink = fmt.Sprintf("/search?q=%s&type=%s&offset=%d",
-			q, qType, offset)
-	}
-
 	data := &SearchData{
 		Q:        q,
 		Type:     qType,
 		Users:    results.Accounts,
 		Statuses: results.Statuses,
-		NextLink: nextLink,
+		Pager:    pager,
 	}
 	return render(rctx, SearchPageTmpl, data)
 }
 
-func SettingsPage(rctx *Context) (err error) {
+func SettingsPage(rctx *Context, feedToken string) (err error) {
 	rctx.title = "settings // 8bloat"
 	return render(rctx, SettingsPageTmpl, &SettingsData{
 		Settings:    &rctx.Settings,
 		PostFormats: rctx.Conf.PostFormats,
+		FeedToken:   feedToken,
+		MaxPageSize: rctx.Conf.MaxPageSize,
 	})
 }
 
-func FiltersPage(rctx *Context, filters []*masta.Filter) (err error) {
+func FiltersPage(rctx *Context, filters []*upstream.Filter) (err error) {
 	rctx.title = "filters // 8bloat"
 	return render(rctx, FiltersPageTmpl, &FiltersData{
-		Filters: filters,
+		Filters:  filters,
+		Contexts: upstream.FilterContexts,
+	})
+}
+
+func RulesPage(rctx *Context, rules []Rule, lists []*masta.List) (err error) {
+	rctx.title = "rules // 8bloat"
+	return render(rctx, RulesPageTmpl, &RulesData{
+		Rules: rules,
+		Kinds: RuleKinds,
+		Lists: lists,
+	})
+}
+
+func AccountsPage(rctx *Context, accounts []AccountData) (err error) {
+	rctx.title = "accounts // 8bloat"
+	return render(rctx, AccountsPageTmpl, &AccountsData{
+		Accounts: accounts,
+	})
+}
+
+func ScheduledPage(rctx *Context, statuses []*upstream.ScheduledStatus) (err error) {
+	rctx.title = "scheduled // 8bloat"
+	loc := rctx.Settings.Location()
+
+	data := &ScheduledData{
+		Statuses: make([]ScheduledStatusData, len(statuses)),
+		Location: loc.String(),
+	}
+
+	for i, v := range statuses {
+		at := v.ScheduledAt.In(loc)
+		data.Statuses[i] = ScheduledStatusData{
+			ScheduledStatus: v,
+			Local:           at.Format("2006-01-02T15:04"),
+			Time:            at.Format(time.RFC822),
+		}
+	}
+
+	return render(rctx, ScheduledPageTmpl, data)
+}
+
+func DraftsPage(rctx *Context, drafts []DraftData) (err error) {
+	rctx.title = "drafts // 8bloat"
+	return render(rctx, DraftsPageTmpl, &DraftsData{
+		Drafts: drafts,
+	})
+}
+
+func DraftPage(rctx *Context, draft DraftData) (err error) {
+	rctx.title = "draft // 8bloat"
+
+	// The draft is gone once it's posted, so go back to the list.
+	rctx.Referrer = "/drafts"
+	return render(rctx, DraftPageTmpl, &DraftPageData{
+		PostContext: PostContext{
+			DefaultVisibility: draft.Visibility,
+			DefaultFormat:     draft.Format,
+			Formats:           postFormats(rctx),
+			DraftContext:      &draft,
+		},
 	})
 }
 
@@ -447,18 +670,32 @@ func ErrorPage(rctx *Context, err error, retry bool) error {
 	var sessionErr bool
 	if err != nil {
 		errStr = err.Error()
-		if me, ok := err.(*masta.APIError); ok {
+		var me *masta.APIError
+		var ue *upstream.Error
+		if errors.As(err, &me) {
 			switch me.Code {
 			case http.StatusForbidden, http.StatusUnauthorized:
 				sessionErr = true
 			}
+		} else if errors.As(err, &ue) {
+			switch ue.Code {
+			case http.StatusForbidden, http.StatusUnauthorized:
+				sessionErr = true
+			}
 		}
 	}
 
+	var rl *RateLimitError
+	if w, ok := rctx.W.(http.ResponseWriter); ok && errors.As(err, &rl) {
+		w.Header().Set("Retry-After", retrySeconds(rl.RetryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+
 	return render(rctx, ErrorPageTmpl, &ErrorData{
 		Context:    rctx,
 		Err:        errStr,
 		Retry:      retry,
 		SessionErr: sessionErr,
+		DraftSaved: errors.Is(err, ErrDraftSaved),
 	})
 }
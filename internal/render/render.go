@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"embed"
 	"html/template"
+	"net/url"
 	"regexp"
+	"slices"
 	"spiderden.org/8bloat/internal/conf"
 	"strconv"
 	"strings"
@@ -19,8 +21,6 @@ var templateFS embed.FS
 
 var tmpl *template.Template = template.Must(template.New("default").Funcs(
 	template.FuncMap{
-		"EmojiFilter":             emojiFilter,
-		"StatusContentFilter":     statusContentFilter,
 		"DisplayInteractionCount": displayInteractionCount,
 		"TimeSince":               timeSince,
 		"TimeUntil":               timeUntil,
@@ -31,14 +31,22 @@ var tmpl *template.Template = template.Must(template.New("default").Funcs(
 		"Raw":                     raw,
 		"RawCSS":                  rawCSS,
 		"wrapRawStatus":           wrapRawStatus,
+		"wrapQuote":               wrapQuote,
 		"version":                 conf.Version,
 		"dbool":                   func(b *bool) bool { return *b },
 		"themes":                  Themes,
 		"themeUIName":             func(name string) string { return themeRegistry[name].UIName },
 		"defaultTheme":            func() string { return conf.DefaultTheme },
+		"reactionEmojis":          func() []string { return reactionEmojis },
+		"seq":                     seq,
+		"ruleKindName":            func(kind string) string { return ruleKindNames[kind] },
 	}).ParseFS(templateFS, "templates/*.tmpl"),
 )
 
+// reactionEmojis are offered in the reaction picker, next to the custom
+// emojis of the instance.
+var reactionEmojis = []string{"👍", "❤️", "😆", "😮", "😢", "😡", "🎉", "🤔", "👀", "🔥"}
+
 func render(ctx *Context, page string, data interface{}) (err error) {
 	return tmpl.ExecuteTemplate(ctx.W, page, withContext(data, ctx))
 }
@@ -50,15 +58,15 @@ type TemplateData struct {
 	Ctx  *Context
 }
 
-func emojiHTML(e masta.Emoji, height string) string {
+func emojiHTML(e masta.Emoji, height string, p MediaProxy) string {
 	esc := template.HTMLEscapeString
-	return `<img class="emoji" src="` + esc(e.URL) + `" alt=":` + esc(e.ShortCode) + `:" title=":` + esc(e.ShortCode) + `:" height="` + esc(height) + `"/>`
+	return `<img class="emoji" src="` + esc(proxyURL(p, e.URL)) + `" alt=":` + esc(e.ShortCode) + `:" title=":` + esc(e.ShortCode) + `:" height="` + esc(height) + `"/>`
 }
 
-func emojiFilter(content string, emojis []masta.Emoji) string {
+func emojiFilter(content string, emojis []masta.Emoji, p MediaProxy) string {
 	var replacements []string
 	for _, e := range emojis {
-		replacements = append(replacements, ":"+e.ShortCode+":", emojiHTML(e, "24"))
+		replacements = append(replacements, ":"+e.ShortCode+":", emojiHTML(e, "24", p))
 	}
 	return strings.NewReplacer(replacements...).Replace(content)
 }
@@ -68,7 +76,10 @@ func emojiFilter(content string, emojis []masta.Emoji) string {
 // catch attempts to open in a frame.
 // TODO: More granular location detection, to allow hosting under
 // a shared domain.
-func linkFilter(content string) string {
+//
+// Images in the content are rewritten to go through the media proxy, if
+// there is one.
+func linkFilter(content string, p MediaProxy) string {
 	node, err := html.Parse(bytes.NewBuffer([]byte(content)))
 	if err != nil {
 		// This is not for security, just to avoid annoyance.
@@ -78,6 +89,14 @@ func linkFilter(content string) string {
 
 	var walk func(node *html.Node)
 	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode && node.Data == "img" && p != nil {
+			for i, v := range node.Attr {
+				if v.Key == "src" {
+					node.Attr[i].Val = proxyURL(p, v.Val)
+				}
+			}
+		}
+
 		if node.Type == html.ElementNode && node.Data == "a" {
 			var reli int = -1
 			var hrefi int = -1
@@ -108,6 +127,10 @@ func linkFilter(content string) string {
 				}
 			}
 
+			if name, ok := hashtag(node); ok && hrefi != -1 {
+				node.Attr[hrefi].Val = "/timeline/tag/" + url.PathEscape(name)
+			}
+
 			if hrefi != -1 {
 				href := node.Attr[hrefi].Val
 				if !strings.HasPrefix(href, "/") {
@@ -144,18 +167,54 @@ func linkFilter(content string) string {
 	return buf.String()
 }
 
+// hashtag returns the name of the hashtag an anchor links to, so that it
+// can link to the tag timeline here instead. Mastodon marks them with a
+// "hashtag" class, Pleroma with rel="tag" and a data-tag attribute.
+func hashtag(node *html.Node) (name string, ok bool) {
+	for _, v := range node.Attr {
+		switch v.Key {
+		case "data-tag":
+			if v.Val != "" {
+				return v.Val, true
+			}
+		case "class":
+			ok = ok || slices.Contains(strings.Fields(v.Val), "hashtag")
+		case "rel":
+			ok = ok || slices.Contains(strings.Fields(v.Val), "tag")
+		}
+	}
+	if !ok {
+		return "", false
+	}
+
+	var text strings.Builder
+	var collect func(n *html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			collect(c)
+		}
+	}
+	collect(node)
+
+	name = strings.TrimPrefix(strings.TrimSpace(text.String()), "#")
+	return name, name != ""
+}
+
 var quoteRE = regexp.MustCompile("(?mU)(^|> *|\n)(&gt;.*)(<br|$)")
 
-func statusContentFilter(content string, emojis []masta.Emoji, mentions []masta.Mention) string {
+func statusContentFilter(content string, emojis []masta.Emoji, mentions []masta.Mention, p MediaProxy) string {
 	content = quoteRE.ReplaceAllString(content, `$1<span class="quote">$2</span>$3`)
 	var replacements []string
 	for _, e := range emojis {
-		replacements = append(replacements, ":"+e.ShortCode+":", emojiHTML(e, "32"))
+		replacements = append(replacements, ":"+e.ShortCode+":", emojiHTML(e, "32", p))
 	}
 	for _, m := range mentions {
 		replacements = append(replacements, `"`+m.URL+`"`, `"/user/`+m.ID+`" title="@`+m.Acct+`"`)
 	}
-	return linkFilter(strings.NewReplacer(replacements...).Replace(content))
+	return linkFilter(strings.NewReplacer(replacements...).Replace(content), p)
 }
 
 func displayInteractionCount(c int64) string {
@@ -227,3 +286,23 @@ func wrapRawStatus(status *masta.Status) StatusData {
 		Status: status,
 	}
 }
+
+// seq returns 0 to n-1, for ranging over in templates.
+func seq(n int) []int {
+	s := make([]int, n)
+	for i := range s {
+		s[i] = i
+	}
+	return s
+}
+
+// quoteMaxDepth is how many quotes deep quoted statuses are shown, deeper
+// ones are only linked to.
+const quoteMaxDepth = 2
+
+func wrapQuote(status *masta.Status, depth int) *QuoteData {
+	return &QuoteData{
+		Status: status,
+		Depth:  depth,
+	}
+}
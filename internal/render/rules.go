@@ -0,0 +1,205 @@
+package render
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"spiderden.org/masta"
+)
+
+// What rules match, besides an account and the text of statuses.
+const (
+	RuleAll             = ""
+	RuleBoosts          = "boosts"
+	RuleReplies         = "replies"
+	RuleStrangerReplies = "stranger_replies"
+	RuleNoMedia         = "no_media"
+)
+
+// RuleKinds are what a rule can match, in the order they're offered.
+var RuleKinds = []string{RuleAll, RuleBoosts, RuleReplies, RuleStrangerReplies, RuleNoMedia}
+
+// Rule hides the statuses of a timeline that match all it has. Timeline
+// is the type of the timeline it's for, or list/ and the ID of a list,
+// and it's for all of them if it's empty. Account is who put the status
+// on the timeline, the one who boosted it for boosts, as user@domain.
+type Rule struct {
+	ID       string `json:"id"`
+	Timeline string `json:"tl,omitempty"`
+	Kind     string `json:"k,omitempty"`
+	Account  string `json:"a,omitempty"`
+	Regexp   string `json:"re,omitempty"`
+}
+
+// Description says what the rule hides.
+func (r Rule) Description() string {
+	var b strings.Builder
+	b.WriteString(ruleKindNames[r.Kind])
+	if r.Account != "" {
+		b.WriteString(" by @" + r.Account)
+	}
+	if r.Regexp != "" {
+		b.WriteString(" matching /" + r.Regexp + "/")
+	}
+	return b.String()
+}
+
+var ruleKindNames = map[string]string{
+	RuleAll:             "posts",
+	RuleBoosts:          "boosts",
+	RuleReplies:         "replies",
+	RuleStrangerReplies: "replies to people you don't follow",
+	RuleNoMedia:         "posts without media",
+}
+
+// RuleCount is how many statuses of a page a rule hid.
+type RuleCount struct {
+	Rule   Rule
+	Hidden int
+}
+
+// FullAcct returns the account as user@domain. Instances leave the domain
+// out for their own accounts, domain is the instance's.
+func FullAcct(acct string, domain string) string {
+	acct = strings.TrimPrefix(acct, "@")
+	if acct != "" && !strings.Contains(acct, "@") {
+		acct += "@" + domain
+	}
+	return acct
+}
+
+// RuleSet is the rules for a timeline, ready to be matched.
+type RuleSet struct {
+	rules  []Rule
+	res    []*regexp.Regexp
+	domain string
+}
+
+// NewRuleSet picks the rules for the timeline. Rules whose regexp doesn't
+// compile, which can't be saved, are left out. domain is the instance's,
+// for the accounts that don't have one.
+func NewRuleSet(rules []Rule, timeline string, domain string) *RuleSet {
+	rs := &RuleSet{domain: domain}
+	for _, r := range rules {
+		if r.Timeline != "" && r.Timeline != timeline {
+			continue
+		}
+
+		var re *regexp.Regexp
+		if r.Regexp != "" {
+			var err error
+			re, err = regexp.Compile(r.Regexp)
+			if err != nil {
+				continue
+			}
+		}
+
+		rs.rules = append(rs.rules, r)
+		rs.res = append(rs.res, re)
+	}
+	return rs
+}
+
+// Empty reports whether no rule is for the timeline.
+func (rs *RuleSet) Empty() bool {
+	return len(rs.rules) == 0
+}
+
+// RepliedTo returns the accounts replied to by the statuses, other than
+// the user, if a rule needs to know whether the user follows them.
+func (rs *RuleSet) RepliedTo(statuses []*masta.Status, userID string) []string {
+	needed := false
+	for _, r := range rs.rules {
+		needed = needed || r.Kind == RuleStrangerReplies
+	}
+	if !needed {
+		return nil
+	}
+
+	var ids []string
+	for _, s := range statuses {
+		if s.Reblog != nil {
+			s = s.Reblog
+		}
+		if id, ok := repliedTo(s); ok && id != userID && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Apply leaves out the statuses a rule matches, and counts how many each
+// rule hid. following is the accounts returned by RepliedTo that the user
+// follows.
+func (rs *RuleSet) Apply(statuses []*masta.Status, userID string, following map[string]bool) ([]*masta.Status, []RuleCount) {
+	counts := make([]int, len(rs.rules))
+	kept := make([]*masta.Status, 0, len(statuses))
+
+	for _, s := range statuses {
+		hidden := false
+		for i := range rs.rules {
+			if rs.match(i, s, userID, following) {
+				counts[i]++
+				hidden = true
+				break
+			}
+		}
+		if !hidden {
+			kept = append(kept, s)
+		}
+	}
+
+	var res []RuleCount
+	for i, n := range counts {
+		if n > 0 {
+			res = append(res, RuleCount{Rule: rs.rules[i], Hidden: n})
+		}
+	}
+	return kept, res
+}
+
+func (rs *RuleSet) match(i int, s *masta.Status, userID string, following map[string]bool) bool {
+	r := rs.rules[i]
+	if r.Account != "" && !strings.EqualFold(FullAcct(r.Account, rs.domain), FullAcct(s.Account.Acct, rs.domain)) {
+		return false
+	}
+
+	// Boosts are matched by what was boosted, other than by who.
+	content := s
+	if s.Reblog != nil {
+		content = s.Reblog
+	}
+
+	switch r.Kind {
+	case RuleBoosts:
+		if s.Reblog == nil {
+			return false
+		}
+	case RuleReplies:
+		if content.InReplyToID == nil {
+			return false
+		}
+	case RuleStrangerReplies:
+		id, ok := repliedTo(content)
+		if !ok || id == userID || following[id] {
+			return false
+		}
+	case RuleNoMedia:
+		if len(content.MediaAttachments) > 0 {
+			return false
+		}
+	}
+
+	if re := rs.res[i]; re != nil && !re.MatchString(filterText(content)) {
+		return false
+	}
+	return true
+}
+
+// repliedTo returns the account a status replies to. masta leaves its ID
+// as it was decoded.
+func repliedTo(s *masta.Status) (string, bool) {
+	id, ok := s.InReplyToAccountID.(string)
+	return id, ok && id != ""
+}
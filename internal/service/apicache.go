@@ -0,0 +1,207 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"spiderden.org/8bloat/internal/upstream"
+
+	"spiderden.org/masta"
+)
+
+// How long responses are cached for. Anything the user changes through
+// 8bloat is invalidated straight away, these only bound how long changes
+// made elsewhere take to show up.
+const (
+	userCacheTTL         = time.Minute
+	accountCacheTTL      = 5 * time.Minute
+	relationshipCacheTTL = time.Minute
+	listCacheTTL         = 10 * time.Minute
+	filterCacheTTL       = 5 * time.Minute
+	emojiCacheTTL        = time.Hour
+)
+
+// maxAPICacheEntries bounds the memory used by the cache. Expired entries
+// are swept when it's reached, and if that isn't enough, the cache is
+// emptied.
+const maxAPICacheEntries = 10000
+
+type apiEntry struct {
+	value   any
+	expires time.Time
+}
+
+// apiCache holds upstream responses that rarely change, so that they
+// aren't fetched on every page view. Cached values are shared between
+// requests and must not be modified.
+type apiCache struct {
+	mu      sync.Mutex
+	entries map[string]apiEntry
+}
+
+func newAPICache() *apiCache {
+	return &apiCache{entries: make(map[string]apiEntry)}
+}
+
+func (c *apiCache) get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *apiCache) put(key string, value any, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxAPICacheEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxAPICacheEntries {
+			c.entries = make(map[string]apiEntry)
+		}
+	}
+
+	c.entries[key] = apiEntry{value: value, expires: time.Now().Add(ttl)}
+}
+
+func (c *apiCache) delete(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, k := range keys {
+		delete(c.entries, k)
+	}
+}
+
+// cacheKey scopes endpoint to the instance and the token in use, since
+// most responses depend on who is asking. The token is hashed so that
+// it isn't kept around any longer than the session.
+func (t *Transaction) cacheKey(endpoint string) string {
+	sum := sha256.Sum256([]byte(t.Client.Config.AccessToken))
+	return t.Client.Config.Server + "\x00" + hex.EncodeToString(sum[:8]) + "\x00" + endpoint
+}
+
+// instanceKey scopes endpoint to the instance only, for responses that
+// are the same for everyone on it.
+func (t *Transaction) instanceKey(endpoint string) string {
+	return t.Client.Config.Server + "\x00\x00" + endpoint
+}
+
+func cached[T any](t *Transaction, key string, ttl time.Duration, fetch func() (T, error)) (T, error) {
+	if v, ok := t.apiCache.get(key); ok {
+		return v.(T), nil
+	}
+
+	v, err := fetch()
+	if err != nil {
+		return v, err
+	}
+
+	t.apiCache.put(key, v, ttl)
+	return v, nil
+}
+
+// invalidate forgets the cached responses for the endpoints, for the
+// current user.
+func (t *Transaction) invalidate(endpoints ...string) {
+	keys := make([]string, len(endpoints))
+	for i, v := range endpoints {
+		keys[i] = t.cacheKey(v)
+	}
+	t.apiCache.delete(keys...)
+}
+
+// invalidateAccount forgets what is cached about an account, after the
+// user's relationship with it changed. The user's own account is
+// included, as its follow counts may have changed too.
+func (t *Transaction) invalidateAccount(id string) {
+	t.invalidate("account/"+id, "relationship/"+id, "me")
+}
+
+// invalidateList forgets what is cached about a list, and the lists.
+func (t *Transaction) invalidateList(id string) {
+	t.invalidate("lists", "list/"+id)
+}
+
+// The methods below shadow those of the embedded masta.Client, so that
+// handlers get cached responses without having to ask for them.
+
+func (t *Transaction) GetAccountCurrentUser(ctx context.Context) (*masta.Account, error) {
+	return cached(t, t.cacheKey("me"), userCacheTTL, func() (*masta.Account, error) {
+		return t.Client.GetAccountCurrentUser(ctx)
+	})
+}
+
+func (t *Transaction) GetAccount(ctx context.Context, id masta.ID) (*masta.Account, error) {
+	return cached(t, t.cacheKey("account/"+string(id)), accountCacheTTL, func() (*masta.Account, error) {
+		return t.Client.GetAccount(ctx, id)
+	})
+}
+
+type accountWithRelationship struct {
+	account *masta.Account
+	rel     *masta.Relationship
+}
+
+func (t *Transaction) GetAccountWithRelationship(ctx context.Context, id masta.ID) (*masta.Account, *masta.Relationship, error) {
+	v, err := cached(t, t.cacheKey("relationship/"+string(id)), relationshipCacheTTL, func() (accountWithRelationship, error) {
+		acct, rel, err := t.Client.GetAccountWithRelationship(ctx, id)
+		return accountWithRelationship{acct, rel}, err
+	})
+	return v.account, v.rel, err
+}
+
+func (t *Transaction) GetInstanceEmojis(ctx context.Context) ([]*masta.Emoji, error) {
+	return cached(t, t.instanceKey("emojis"), emojiCacheTTL, func() ([]*masta.Emoji, error) {
+		return t.Client.GetInstanceEmojis(ctx)
+	})
+}
+
+// getFilters returns the user's filters, in the shape of filters v2
+// whichever API the instance has.
+func (t *Transaction) getFilters(ctx context.Context) ([]*upstream.Filter, error) {
+	return cached(t, t.cacheKey("filters"), filterCacheTTL, func() ([]*upstream.Filter, error) {
+		if t.Caps.SupportsFiltersV2 {
+			return t.Up.GetFilters(ctx)
+		}
+
+		v1, err := t.Client.GetFilters(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		filters := make([]*upstream.Filter, len(v1))
+		for i, v := range v1 {
+			filters[i] = upstream.FilterV1(v)
+		}
+		return filters, nil
+	})
+}
+
+func (t *Transaction) GetLists(ctx context.Context) ([]*masta.List, error) {
+	return cached(t, t.cacheKey("lists"), listCacheTTL, func() ([]*masta.List, error) {
+		return t.Client.GetLists(ctx)
+	})
+}
+
+func (t *Transaction) GetList(ctx context.Context, id masta.ID) (*masta.List, error) {
+	return cached(t, t.cacheKey("list/"+string(id)), listCacheTTL, func() (*masta.List, error) {
+		return t.Client.GetList(ctx, id)
+	})
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"spiderden.org/8bloat/internal/conf"
+	"strings"
+	"sync"
+	"time"
+
+	"spiderden.org/8bloat/internal/upstream"
+
+	"spiderden.org/masta"
+)
+
+var errNoApp = errors.New("no app registered")
+
+// appVerifyAge is how long an app is used before checking that the
+// instance still accepts it. An app the instance no longer accepts is
+// otherwise caught at the callback, see rejectedApp.
+const appVerifyAge = 24 * time.Hour
+
+// App is an OAuth application registered with an instance.
+type App struct {
+	ClientID     string    `json:"id"`
+	ClientSecret string    `json:"secret"`
+	Registered   time.Time `json:"at"`
+	Verified     time.Time `json:"verified,omitempty"`
+}
+
+// AppStore keeps the apps registered with instances, so that signing in
+// doesn't register a new one every time. It uses the same backend as the
+// session store. Implementations must be safe for concurrent use, and
+// must return errNoApp for unknown keys.
+type AppStore interface {
+	Get(key string) (*App, error)
+	Put(key string, app *App) error
+	Delete(key string) error
+}
+
+func newAppStore(config conf.Configuration) (AppStore, error) {
+	switch config.SessionStore {
+	case "", "memory":
+		return &memoryAppStore{apps: make(map[string]App)}, nil
+	case "file":
+		return newFileAppStore(filepath.Join(config.DatabasePath, "apps"))
+	default:
+		return nil, errors.New("unknown session store " + config.SessionStore)
+	}
+}
+
+// appKey identifies an app by what it was registered with, so that
+// changing the configuration registers a new one.
+func appKey(config *conf.Configuration, instance string) string {
+	return strings.ToLower(instance) + "\n" + config.ClientWebsite + "/oauth_callback\n" + config.ClientScope + "\n" + config.ClientName
+}
+
+type memoryAppStore struct {
+	mu   sync.Mutex
+	apps map[string]App
+}
+
+func (m *memoryAppStore) Get(key string) (*App, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	app, ok := m.apps[key]
+	if !ok {
+		return nil, errNoApp
+	}
+	return &app, nil
+}
+
+func (m *memoryAppStore) Put(key string, app *App) error {
+	m.mu.Lock()
+	m.apps[key] = *app
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryAppStore) Delete(key string) error {
+	m.mu.Lock()
+	delete(m.apps, key)
+	m.mu.Unlock()
+	return nil
+}
+
+// fileAppStore keeps each app in its own file under dir. Apps don't
+// expire, they are only replaced when the instance rejects them.
+type fileAppStore struct {
+	dir string
+}
+
+func newFileAppStore(dir string) (*fileAppStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileAppStore{dir: dir}, nil
+}
+
+func (f *fileAppStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:]))
+}
+
+func (f *fileAppStore) Get(key string) (*App, error) {
+	data, err := os.ReadFile(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errNoApp
+	} else if err != nil {
+		return nil, err
+	}
+
+	var app App
+	err = json.Unmarshal(data, &app)
+	return &app, err
+}
+
+func (f *fileAppStore) Put(key string, app *App) error {
+	data, err := json.Marshal(app)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(f.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path(key))
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+func (f *fileAppStore) Delete(key string) error {
+	err := os.Remove(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// authURL is where the user is sent to authorise the app.
+func authURL(config *conf.Configuration, instanceURL string, app *App) string {
+	v := url.Values{}
+	v.Set("client_id", app.ClientID)
+	v.Set("response_type", "code")
+	v.Set("redirect_uri", config.ClientWebsite+"/oauth_callback")
+	v.Set("scope", config.ClientScope)
+	return instanceURL + "/oauth/authorize?" + v.Encode()
+}
+
+// app returns the app registered with the instance, registering one if
+// there's none or the instance no longer accepts it. If the instance
+// can't say, the app is used as it is.
+func (t *Transaction) app(instance string, instanceURL string) (*App, error) {
+	key := appKey(t.Conf, instance)
+
+	app, err := t.apps.Get(key)
+	if err == nil {
+		if time.Since(app.Verified) < appVerifyAge {
+			return app, nil
+		}
+
+		ok, verr := t.verifyApp(instanceURL, app)
+		if verr != nil {
+			t.log.Warn("error verifying app", "instance", instance, "err", verr)
+			return app, nil
+		}
+		if ok {
+			app.Verified = time.Now()
+			if err = t.apps.Put(key, app); err != nil {
+				t.log.Warn("error saving app", "instance", instance, "err", err)
+			}
+			return app, nil
+		}
+		t.log.Info("instance rejected app, registering a new one", "instance", instance)
+	} else if !errors.Is(err, errNoApp) {
+		t.log.Warn("error reading app", "instance", instance, "err", err)
+	}
+
+	registered, err := masta.RegisterApp(t.Ctx, &masta.AppConfig{
+		Client:       *t.h,
+		Server:       instanceURL,
+		ClientName:   t.Conf.ClientName,
+		Scopes:       t.Conf.ClientScope,
+		Website:      t.Conf.ClientWebsite,
+		RedirectURIs: t.Conf.ClientWebsite + "/oauth_callback",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	app = &App{
+		ClientID:     registered.ClientID,
+		ClientSecret: registered.ClientSecret,
+		Registered:   now,
+		Verified:     now,
+	}
+
+	if err = t.apps.Put(key, app); err != nil {
+		// Signing in still works, the next one will register again.
+		t.log.Warn("error saving app", "instance", instance, "err", err)
+	}
+
+	return app, nil
+}
+
+func (t *Transaction) verifyApp(instanceURL string, app *App) (bool, error) {
+	client := masta.NewClient(&masta.Config{
+		Server:       instanceURL,
+		ClientID:     app.ClientID,
+		ClientSecret: app.ClientSecret,
+	})
+	client.UserAgent = t.Conf.UserAgent
+	client.Client = *t.h
+
+	return upstream.New(client).VerifyApp(t.Ctx, t.Conf.ClientScope)
+}
+
+// rejectedApp forgets the app of the identity, after the instance refused
+// it when signing in, so that the next sign in registers a new one.
+func (t *Transaction) rejectedApp(ident *Identity) {
+	key := appKey(t.Conf, ident.Instance)
+
+	app, err := t.apps.Get(key)
+	if err != nil || app.ClientID != ident.ClientID {
+		return
+	}
+
+	if err = t.apps.Delete(key); err != nil {
+		t.log.Warn("error removing app", "instance", ident.Instance, "err", err)
+	}
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"golang.org/x/sync/singleflight"
+	"log/slog"
+	"spiderden.org/8bloat/internal/upstream"
+	"sync"
+	"time"
+)
+
+const (
+	capsLifetime = 6 * time.Hour
+
+	// capsRetry is how long a failed probe is kept, so that an instance
+	// that's down isn't probed again on every request.
+	capsRetry = time.Minute
+)
+
+type capsEntry struct {
+	caps    *upstream.Caps
+	expires time.Time
+}
+
+// capsCache keeps what each instance supports, so that it's only probed
+// once in a while rather than on every request.
+type capsCache struct {
+	mu      sync.Mutex
+	entries map[string]capsEntry
+	probes  singleflight.Group
+}
+
+func newCapsCache() *capsCache {
+	return &capsCache{entries: make(map[string]capsEntry)}
+}
+
+// get never fails, if the instance can't be probed, what it supported
+// before is used, or the default capabilities if it was never probed,
+// until it's probed again after capsRetry. Concurrent requests for the
+// same instance share a single probe.
+func (c *capsCache) get(ctx context.Context, instance string, up *upstream.Client) *upstream.Caps {
+	c.mu.Lock()
+	e, ok := c.entries[instance]
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(e.expires) {
+		return e.caps
+	}
+
+	v, _, _ := c.probes.Do(instance, func() (interface{}, error) {
+		// The probe is shared, it shouldn't fail for everyone because
+		// the request that started it went away.
+		caps, err := up.Probe(context.WithoutCancel(ctx))
+		lifetime := capsLifetime
+		if err != nil {
+			slog.Warn("error probing instance", "instance", instance, "err", err)
+			caps, lifetime = upstream.DefaultCaps(), capsRetry
+			if ok {
+				caps = e.caps
+			}
+		}
+
+		c.mu.Lock()
+		c.entries[instance] = capsEntry{caps: caps, expires: time.Now().Add(lifetime)}
+		c.mu.Unlock()
+
+		return caps, nil
+	})
+	return v.(*upstream.Caps)
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"fmt"
+	"spiderden.org/8bloat/internal/render"
+	"time"
+)
+
+// maxDrafts is how many drafts are kept for each identity, the oldest
+// ones are dropped after that.
+const maxDrafts = 50
+
+type Draft struct {
+	ID         string    `json:"id"`
+	ReplyToID  string    `json:"rid,omitempty"`
+	EditID     string    `json:"eid,omitempty"`
+	QuoteID    string    `json:"qid,omitempty"`
+	MediaIDs   []string  `json:"mids,omitempty"`
+	Visibility string    `json:"vis,omitempty"`
+	Format     string    `json:"fmt,omitempty"`
+	Subject    string    `json:"sub,omitempty"`
+	Content    string    `json:"con,omitempty"`
+	Saved      time.Time `json:"saved"`
+}
+
+func (d *Draft) empty() bool {
+	return d.Subject == "" && d.Content == "" && len(d.MediaIDs) == 0
+}
+
+func (d *Draft) data() render.DraftData {
+	return render.DraftData{
+		ID:         d.ID,
+		ReplyToID:  d.ReplyToID,
+		EditID:     d.EditID,
+		QuoteID:    d.QuoteID,
+		MediaIDs:   d.MediaIDs,
+		Visibility: d.Visibility,
+		Format:     d.Format,
+		Subject:    d.Subject,
+		Content:    d.Content,
+		Saved:      d.Saved,
+	}
+}
+
+// draftFromForm reads a draft from the fields of the post form.
+func (t *Transaction) draftFromForm() *Draft {
+	return &Draft{
+		ID:         t.R.FormValue("draft_id"),
+		ReplyToID:  t.R.FormValue("reply_to_id"),
+		EditID:     t.R.FormValue("id"),
+		QuoteID:    t.R.FormValue("quote_id"),
+		MediaIDs:   t.R.Form["media_ids"],
+		Visibility: t.R.FormValue("visibility"),
+		Format:     t.R.FormValue("format"),
+		Subject:    t.R.FormValue("subject"),
+		Content:    t.R.FormValue("content"),
+	}
+}
+
+func (t *Transaction) draft(id string) *Draft {
+	for _, v := range t.Session.Identity().Drafts {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// saveDraft adds the draft, or replaces the one with the same ID.
+func (t *Transaction) saveDraft(d *Draft) error {
+	ident := t.Session.Identity()
+
+	if d.ID == "" || t.draft(d.ID) == nil {
+		d.ID = t.sfnode.Generate().String()
+	}
+	d.Saved = time.Now()
+
+	drafts := []*Draft{d}
+	for _, v := range ident.Drafts {
+		if v.ID != d.ID && len(drafts) < maxDrafts {
+			drafts = append(drafts, v)
+		}
+	}
+	ident.Drafts = drafts
+
+	return t.setSession(t.Session)
+}
+
+func (t *Transaction) removeDraft(id string) error {
+	ident := t.Session.Identity()
+
+	drafts := ident.Drafts[:0]
+	for _, v := range ident.Drafts {
+		if v.ID != id {
+			drafts = append(drafts, v)
+		}
+	}
+	ident.Drafts = drafts
+
+	return t.setSession(t.Session)
+}
+
+// captureDraft keeps the post form as a draft when posting fails, since
+// the error page replaces the form. mediaIDs are the attachments that
+// were already uploaded.
+func (t *Transaction) captureDraft(mediaIDs []string, err error) error {
+	d := t.draftFromForm()
+	d.MediaIDs = mediaIDs
+	if d.empty() {
+		return err
+	}
+
+	if serr := t.saveDraft(d); serr != nil {
+		t.log.Warn("error saving draft", "err", serr)
+		return err
+	}
+
+	return fmt.Errorf("%w, %w", err, render.ErrDraftSaved)
+}
+
+// postedDraft removes the draft the post was resumed from, if any.
+func (t *Transaction) postedDraft() {
+	id := t.R.FormValue("draft_id")
+	if id == "" {
+		return
+	}
+
+	if err := t.removeDraft(id); err != nil {
+		t.log.Warn("error removing draft", "draft_id", id, "err", err)
+	}
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"spiderden.org/8bloat/internal/conf"
+	"sync"
+	"time"
+)
+
+// FeedLink is what a feed token stands for.
+type FeedLink struct {
+	Session  string `json:"sess"`
+	Identity string `json:"id"`
+}
+
+// FeedStore keeps what each feed token stands for, so that the token is
+// opaque and doesn't disclose the session ID. It uses the same backend as
+// the session store. Links expire like sessions do. Implementations must
+// be safe for concurrent use, and must return errInvalidSession for
+// unknown or expired tokens.
+type FeedStore interface {
+	Get(token string) (*FeedLink, error)
+	Put(token string, link *FeedLink) error
+	Delete(token string) error
+}
+
+func newFeedStore(config conf.Configuration) (FeedStore, error) {
+	switch config.SessionStore {
+	case "", "memory":
+		return &memoryFeedStore{links: make(map[string]memoryFeedLink)}, nil
+	case "file":
+		return newFileFeedStore(filepath.Join(config.DatabasePath, "feeds"))
+	default:
+		return nil, errors.New("unknown session store " + config.SessionStore)
+	}
+}
+
+type memoryFeedLink struct {
+	link    FeedLink
+	expires time.Time
+}
+
+type memoryFeedStore struct {
+	mu    sync.Mutex
+	links map[string]memoryFeedLink
+}
+
+func (m *memoryFeedStore) Get(token string) (*FeedLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.links[token]
+	if !ok || time.Now().After(e.expires) {
+		return nil, errInvalidSession
+	}
+	return &e.link, nil
+}
+
+func (m *memoryFeedStore) Put(token string, link *FeedLink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range m.links {
+		if now.After(v.expires) {
+			delete(m.links, k)
+		}
+	}
+
+	m.links[token] = memoryFeedLink{link: *link, expires: now.Add(sessionLifetime)}
+	return nil
+}
+
+func (m *memoryFeedStore) Delete(token string) error {
+	m.mu.Lock()
+	delete(m.links, token)
+	m.mu.Unlock()
+	return nil
+}
+
+// fileFeedStore keeps each link in its own file under dir. The
+// modification time of the file is used to expire it.
+type fileFeedStore struct {
+	dir string
+}
+
+func newFileFeedStore(dir string) (*fileFeedStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	f := &fileFeedStore{dir: dir}
+	f.sweep()
+	return f, nil
+}
+
+// path hashes the token, so it can never escape the directory, and isn't
+// disclosed by the file name.
+func (f *fileFeedStore) path(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:]))
+}
+
+func (f *fileFeedStore) Get(token string) (*FeedLink, error) {
+	p := f.path(token)
+
+	stat, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errInvalidSession
+	} else if err != nil {
+		return nil, err
+	}
+
+	if time.Since(stat.ModTime()) > sessionLifetime {
+		os.Remove(p)
+		return nil, errInvalidSession
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var link FeedLink
+	err = json.Unmarshal(data, &link)
+	return &link, err
+}
+
+func (f *fileFeedStore) Put(token string, link *FeedLink) error {
+	data, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(f.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path(token))
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+func (f *fileFeedStore) Delete(token string) error {
+	err := os.Remove(f.path(token))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *fileFeedStore) sweep() {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return
+	}
+
+	for _, v := range entries {
+		info, err := v.Info()
+		if err != nil || v.IsDir() {
+			continue
+		}
+
+		if time.Since(info.ModTime()) > sessionLifetime {
+			os.Remove(filepath.Join(f.dir, v.Name()))
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"embed"
+	"errors"
 	"fmt"
 	"github.com/bwmarrin/snowflake"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"reflect"
+	"slices"
 	"spiderden.org/8bloat/internal/conf"
 	"strconv"
 	"strings"
@@ -16,6 +20,7 @@ import (
 
 	"github.com/julienschmidt/httprouter"
 	"spiderden.org/8bloat/internal/render"
+	"spiderden.org/8bloat/internal/upstream"
 	"spiderden.org/masta"
 )
 
@@ -32,55 +37,183 @@ type handle struct {
 	f      handler
 	notype bool
 	meth   string
+	path   string
 }
 
-func (h handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (h handle) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	cfgv := r.Context().Value("conf")
 	cfg, ok := cfgv.(conf.Configuration)
 	if !ok {
-		log.Println("error reading conf context value, type:", reflect.TypeOf(cfgv))
-		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("error reading conf context value", "type", reflect.TypeOf(cfgv))
+		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	clv := r.Context().Value("client")
 	cl, ok := clv.(*http.Client)
 	if !ok {
-		log.Println("error reading client context value")
-		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("error reading client context value")
+		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	sfv := r.Context().Value("sfnode")
 	sf, ok := sfv.(*snowflake.Node)
 	if !ok {
-		log.Println("error reading sfnode context value")
-		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("error reading sfnode context value")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	slv := r.Context().Value("sealer")
+	sl, ok := slv.(*sealer)
+	if !ok {
+		slog.Error("error reading sealer context value")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	apv := r.Context().Value("apps")
+	ap, ok := apv.(AppStore)
+	if !ok {
+		slog.Error("error reading apps context value")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	fdv := r.Context().Value("feeds")
+	fd, ok := fdv.(FeedStore)
+	if !ok {
+		slog.Error("error reading feeds context value")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	stv := r.Context().Value("store")
+	st, ok := stv.(SessionStore)
+	if !ok {
+		slog.Error("error reading store context value")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	cpv := r.Context().Value("caps")
+	cp, ok := cpv.(*capsCache)
+	if !ok {
+		slog.Error("error reading caps context value")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	acv := r.Context().Value("apicache")
+	ac, ok := acv.(*apiCache)
+	if !ok {
+		slog.Error("error reading apicache context value")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	pxv := r.Context().Value("proxy")
+	px, ok := pxv.(*mediaProxy)
+	if !ok {
+		slog.Error("error reading proxy context value")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	lmv := r.Context().Value("limits")
+	lm, ok := lmv.(*limits)
+	if !ok {
+		slog.Error("error reading limits context value")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	mtv := r.Context().Value("metrics")
+	mt, ok := mtv.(*metrics)
+	if !ok {
+		slog.Error("error reading metrics context value")
+		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	var err error
+	begin := time.Now()
 
 	vars := httprouter.ParamsFromContext(r.Context())
 
+	id := sf.Generate().String()
+	rw.Header().Set("X-Request-Id", id)
+	w := &statusWriter{ResponseWriter: rw}
+
+	// Every upstream request made for this request goes through its own
+	// client, so that they can be counted.
+	stats := &upstreamStats{}
+	hc := *cl
+	hc.Transport = stats.Transport(cl.Transport)
+
 	t := &Transaction{
-		Ctx:    r.Context(),
-		W:      w,
-		R:      r,
-		Conf:   &cfg,
-		h:      cl,
-		sfnode: sf,
-		Vars:   make(map[string]string, len(vars)),
-		Qry:    make(map[string]string, len(r.URL.Query())),
-	}
+		Ctx:      r.Context(),
+		W:        w,
+		R:        r,
+		Conf:     &cfg,
+		h:        &hc,
+		stats:    stats,
+		log:      slog.Default().With("request_id", id),
+		metrics:  mt,
+		limits:   lm,
+		sfnode:   sf,
+		sealer:   sl,
+		store:    st,
+		apps:     ap,
+		feeds:    fd,
+		caps:     cp,
+		apiCache: ac,
+		quotes:   upstream.NewQuotes(),
+		filtered: upstream.NewFiltered(),
+		proxy:    px,
+		Vars:     make(map[string]string, len(vars)),
+		Qry:      make(map[string]string, len(r.URL.Query())),
+	}
+
+	defer func() {
+		took := time.Since(begin)
+		status := w.Status()
+		mt.observe(h.meth, h.path, status, err != nil, took, stats)
+
+		requests, _, _ := stats.snapshot()
+		attrs := []any{
+			"method", r.Method,
+			"route", h.path,
+			"path", r.URL.Path,
+			"status", status,
+			"took", took,
+			"upstream_requests", requests,
+			"upstream_took", stats.total(),
+		}
+		if t.Session != nil && t.Session.IsLoggedIn() {
+			attrs = append(attrs, "instance", t.Session.Identity().Instance)
+		}
+		if err != nil {
+			attrs = append(attrs, "err", err)
+		}
+
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		t.log.Log(r.Context(), level, "request", attrs...)
+	}()
 
 	err = t.authenticate(h.am)
 	t.Rctx.W = w
+	t.Rctx.Conf = &cfg
 	if err != nil {
 		eerr := render.ErrorPage(t.Rctx, err, true)
 		if eerr != nil {
-			log.Println("error responding with error page:", err, eerr)
+			t.log.Error("error responding with error page", "err", err, "page_err", eerr)
 		}
+		return
 	}
 
 	for _, v := range vars {
@@ -91,37 +224,46 @@ func (h handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		t.Qry[k] = v[0]
 	}
 
-	defer func(begin time.Time) {
-		log.Printf("path=%s, err=%v, took=%v\n",
-			r.URL.Path, err, time.Since(begin))
-	}(time.Now())
-
 	if !h.notype {
 		w.Header().Set("Content-type", "text/html; charset=utf-8")
 	}
 
+	// With the media proxy, nothing should be loaded from elsewhere.
+	mediaSrc := "*"
+	if t.proxy != nil {
+		mediaSrc = cfg.ClientWebsite + "/"
+	}
+
 	t.W.Header().Set("Cache-Control", "private")
 	t.W.Header().Set("Content-Security-Policy",
 		"default-src "+cfg.ClientWebsite+"/;"+
 			"style-src "+cfg.ClientWebsite+"/session/css "+cfg.ClientWebsite+"/session/css/ "+cfg.ClientWebsite+"/theme/;"+
 			"script-src "+cfg.ClientWebsite+"/static/;"+
-			"img-src *;"+
-			"media-src *",
+			"img-src "+mediaSrc+";"+
+			"media-src "+mediaSrc,
 	)
 	t.W.Header().Set("Referer-Policy", "same-origin")
 
 	if t.Session != nil {
 		t.Rctx.Conf = &cfg
-		t.Rctx.UserID = t.Session.UserID
+		t.Rctx.UserID = t.Session.UserID()
 		t.Rctx.Settings = t.Session.Settings
 		t.Rctx.CSRFToken = t.Session.CSRFToken
 	}
 
+	if t.Caps != nil {
+		t.Rctx.Caps = *t.Caps
+	}
+
+	if t.proxy != nil {
+		t.Rctx.Proxy = t.proxy
+	}
+
 	err = h.f(t)
 	if err != nil {
 		eerr := render.ErrorPage(t.Rctx, err, true)
 		if eerr != nil {
-			log.Println("error responding with error page:", err, eerr)
+			t.log.Error("error responding with error page", "err", err, "page_err", eerr)
 		}
 	}
 }
@@ -129,6 +271,7 @@ func (h handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func reg(h handler, meth string, path string, opts ...int) {
 	handle := handle{}
 	handle.meth = meth
+	handle.path = path
 
 	noauth := false
 	nocsrf := false
@@ -183,7 +326,7 @@ func handleNav(t *Transaction) error {
 		return err
 	}
 
-	return render.NavPage(t.Rctx, user)
+	return render.NavPage(t.Rctx, user, t.Session.accounts())
 }
 
 func init() { reg(handleSigninGet, http.MethodGet, "/signin", noAuth) }
@@ -193,14 +336,7 @@ func handleSigninGet(t *Transaction) error {
 		return render.SigninPage(t.Rctx)
 	}
 
-	url, sess, err := newSession(t, instance)
-	if err != nil {
-		return err
-	}
-
-	t.setSession(sess)
-	t.redirect(url)
-	return nil
+	return beginSignin(t, instance)
 }
 
 func init() { reg(handleTimeline, http.MethodGet, "/timeline/:type") }
@@ -208,100 +344,156 @@ func handleTimeline(t *Transaction) error {
 	tType := t.Vars["type"]
 	instance := t.Qry["instance"]
 	list := t.Qry["list"]
-	maxID := t.Qry["max_id"]
-	minID := t.Qry["min_id"]
 
-	var nextLink, prevLink, title string
-	var statuses []*masta.Status
-	pg := masta.Pagination{
-		MaxID: maxID,
-		MinID: minID,
-		Limit: conf.MaxPagination,
+	p := newPager(t)
+	statuses, title, err := getTimeline(t, tType, instance, list, &p.pg)
+	if err != nil {
+		return err
 	}
 
-	var err error
+	// The pages around are the instance's, whatever the rules hide.
+	links := statusLinks(p, statuses)
 
-	switch tType {
+	timeline := tType
+	if tType == "list" {
+		timeline = "list/" + list
+	}
+	statuses, hidden := t.applyRules(timeline, statuses)
+
+	data := &render.TimelineData{
+		Title:    title,
+		Type:     tType,
+		Instance: instance,
+		Statuses: statuses,
+		Pager:    links,
+		Hidden:   hidden,
+	}
+
+	loadFilters(t)
+	return render.TimelinePage(t.Rctx, data)
+}
+
+func init() { reg(handleTagTimeline, http.MethodGet, "/timeline/:type/:name") }
+func handleTagTimeline(t *Transaction) error {
+	// The router can't have /timeline/tag/:name next to
+	// /timeline/:type, so tag is matched here.
+	if t.Vars["type"] != "tag" {
+		return errInvalidArgument
+	}
+
+	name := t.Vars["name"]
+	only := t.Qry["only"]
+
+	switch only {
+	case upstream.TagAll, upstream.TagLocal, upstream.TagRemote:
 	default:
 		return errInvalidArgument
-	case "home":
-		statuses, err = t.GetTimelineHome(t.Ctx, &pg)
-		if err != nil {
-			return err
+	}
+
+	p := newPager(t)
+
+	var (
+		statuses []*masta.Status
+		tag      = &upstream.Tag{Name: name}
+		fetchTag func(ctx context.Context) error
+	)
+
+	// Instances that can't follow hashtags can't say whether one is
+	// followed either.
+	if t.Caps.SupportsFollowTags {
+		fetchTag = func(ctx context.Context) (err error) {
+			tag, err = t.Up.GetTag(ctx, name)
+			return
 		}
+	}
+
+	err := t.parallel(
+		func(ctx context.Context) (err error) {
+			statuses, err = t.Up.GetTagTimeline(ctx, name, only, &p.pg)
+			return
+		},
+		fetchTag,
+	)
+	if err != nil {
+		return err
+	}
+
+	links := statusLinks(p, statuses)
+	statuses, hidden := t.applyRules("tag", statuses)
+
+	data := &render.TimelineData{
+		Title:    "#" + tag.Name,
+		Type:     "tag",
+		Statuses: statuses,
+		Pager:    links,
+		Tag:      tag,
+		Only:     only,
+		Hidden:   hidden,
+	}
+
+	loadFilters(t)
+	return render.TimelinePage(t.Rctx, data)
+}
+
+// loadFilters gets the user's filters for the page to match statuses
+// against, on instances without filters v2. The page is still shown
+// unfiltered if they can't be had.
+func loadFilters(t *Transaction) {
+	if t.Caps.SupportsFiltersV2 {
+		return
+	}
+
+	filters, err := t.getFilters(t.Ctx)
+	if err != nil {
+		t.log.Warn("error getting filters", "err", err)
+		return
+	}
+	t.Rctx.Filters = filters
+}
+
+func getTimeline(t *Transaction, tType, instance, list string, pg *masta.Pagination) (statuses []*masta.Status, title string, err error) {
+	switch tType {
+	default:
+		return nil, "", errInvalidArgument
+	case "home":
+		statuses, err = t.GetTimelineHome(t.Ctx, pg)
 		title = "Timeline"
 	case "direct":
-		statuses, err = t.GetTimelineDirect(t.Ctx, &pg)
-		if err != nil {
-			return err
-		}
+		statuses, err = t.GetTimelineDirect(t.Ctx, pg)
 		title = "Direct Timeline"
 	case "local":
-		statuses, err = t.GetTimelinePublic(t.Ctx, true, &pg)
-		if err != nil {
-			return err
-		}
+		statuses, err = t.GetTimelinePublic(t.Ctx, true, pg)
 		title = "Local Timeline"
 	case "remote":
+		if !t.Caps.SupportsRemoteTimeline {
+			return nil, "", errUnsupported
+		}
 		if len(instance) > 0 {
-			statuses, err = t.PlGetTimelineRemote(t.Ctx, instance, &pg)
-			if err != nil {
-				return err
-			}
+			statuses, err = t.PlGetTimelineRemote(t.Ctx, instance, pg)
 		}
 		title = "Remote Timeline"
 	case "twkn":
-		statuses, err = t.GetTimelinePublic(t.Ctx, false, &pg)
-		if err != nil {
-			return err
-		}
+		statuses, err = t.GetTimelinePublic(t.Ctx, false, pg)
 		title = "The Whole Known Network"
 	case "list":
-		statuses, err = t.GetTimelineList(t.Ctx, list, &pg)
-		if err != nil {
-			return err
-		}
-		list, err := t.GetList(t.Ctx, list)
+		var l *masta.List
+		err = t.parallel(
+			func(ctx context.Context) (err error) {
+				statuses, err = t.GetTimelineList(ctx, list, pg)
+				return
+			},
+			func(ctx context.Context) (err error) {
+				l, err = t.GetList(ctx, list)
+				return
+			},
+		)
 		if err != nil {
-			return err
-		}
-		title = "List Timeline - " + list.Title
-	}
-
-	if (len(maxID) > 0 || len(minID) > 0) && len(statuses) > 0 {
-		v := make(url.Values)
-		v.Set("min_id", statuses[0].ID)
-		if len(instance) > 0 {
-			v.Set("instance", instance)
-		}
-		if len(list) > 0 {
-			v.Set("list", list)
-		}
-		prevLink = "/timeline/" + tType + "?" + v.Encode()
-	}
-
-	if len(minID) > 0 || (len(pg.MaxID) > 0 && len(statuses) == 20) {
-		v := make(url.Values)
-		v.Set("max_id", pg.MaxID)
-		if len(instance) > 0 {
-			v.Set("instance", instance)
-		}
-		if len(list) > 0 {
-			v.Set("list", list)
+			return
 		}
-		nextLink = "/timeline/" + tType + "?" + v.Encode()
+		title = "List Timeline - " + l.Title
 	}
 
-	data := &render.TimelineData{
-		Title:    title,
-		Type:     tType,
-		Instance: instance,
-		Statuses: statuses,
-		NextLink: nextLink,
-		PrevLink: prevLink,
-	}
-
-	return render.TimelinePage(t.Rctx, data)
+	return
 }
 
 func init() { reg(handleDefaultTimeline, http.MethodGet, "/timeline") }
@@ -314,26 +506,41 @@ func init() { reg(handleThread, http.MethodGet, "/thread/:id") }
 func handleThread(t *Transaction) error {
 	reply := len(t.Qry["reply"]) > 0
 	edit := len(t.Qry["edit"]) > 0
+	quote := len(t.Qry["quote"]) > 0 && t.Caps.SupportsQuotes
 
-	status, err := t.Client.GetStatus(t.Ctx, t.Vars["id"])
-	if err != nil {
-		return err
-	}
+	id := t.Vars["id"]
 
-	context, err := t.Client.GetStatusContext(t.Ctx, status.ID)
-	if err != nil {
-		return err
-	}
+	var (
+		status    *masta.Status
+		statusCtx *masta.Context
+		src       *masta.Source
+		fetchSrc  func(ctx context.Context) error
+	)
 
-	var src *masta.Source
 	if edit {
-		src, err = t.Client.GetStatusSource(t.Ctx, status.ID)
-		if err != nil {
-			return err
+		fetchSrc = func(ctx context.Context) (err error) {
+			src, err = t.Client.GetStatusSource(ctx, id)
+			return
 		}
 	}
 
-	return render.ThreadPage(t.Rctx, status, context, (edit || reply), src)
+	err := t.parallel(
+		func(ctx context.Context) (err error) {
+			status, err = t.Client.GetStatus(ctx, id)
+			return
+		},
+		func(ctx context.Context) (err error) {
+			statusCtx, err = t.Client.GetStatusContext(ctx, id)
+			return
+		},
+		fetchSrc,
+	)
+	if err != nil {
+		return err
+	}
+
+	loadFilters(t)
+	return render.ThreadPage(t.Rctx, status, statusCtx, (edit || reply || quote), quote, src)
 }
 
 func init() { reg(handleQuickReply, http.MethodGet, "/quickreply/:id") }
@@ -357,42 +564,63 @@ func handleQuickReply(t *Transaction) error {
 
 func init() { reg(handleLikedBy, http.MethodGet, "/likedby/:id") }
 func handleLikedBy(t *Transaction) error {
-	accts, err := t.GetFavouritedBy(t.Ctx, t.Vars["id"], nil)
+	p := newPager(t)
+	accts, err := t.GetFavouritedBy(t.Ctx, t.Vars["id"], &p.pg)
 	if err != nil {
 		return err
 	}
 
-	return render.LikedByPage(t.Rctx, accts)
+	return render.LikedByPage(t.Rctx, accts, accountLinks(p, accts))
 }
 
 func init() { reg(handleRetweetedBy, http.MethodGet, "/retweetedby/:id") }
 func handleRetweetedBy(t *Transaction) error {
-	accts, err := t.GetRebloggedBy(t.Ctx, t.Vars["id"], nil)
+	p := newPager(t)
+	accts, err := t.GetRebloggedBy(t.Ctx, t.Vars["id"], &p.pg)
 	if err != nil {
 		return err
 	}
 
-	return render.RetweetedByPage(t.Rctx, accts)
+	return render.RetweetedByPage(t.Rctx, accts, accountLinks(p, accts))
 }
 
 func init() { reg(handleReactions, http.MethodGet, "/reactions/:id") }
 func handleReactions(t *Transaction) error {
-	reactions, err := t.PlGetReactions(t.Ctx, t.Vars["id"], false)
+	if !t.Caps.SupportsReactions {
+		return errUnsupported
+	}
+
+	id := t.Vars["id"]
+	reactions, err := t.Up.GetReactions(t.Ctx, id)
+	if err != nil {
+		return err
+	}
+
+	emojis, err := t.GetInstanceEmojis(t.Ctx)
 	if err != nil {
 		return err
 	}
 
-	return render.ReactionsPage(t.Rctx, reactions)
+	return render.ReactionsPage(t.Rctx, id, reactions, emojis)
 }
 
 func init() { reg(handleEdits, http.MethodGet, "/status/:id/edits") }
 func handleEdits(t *Transaction) error {
-	edits, err := t.GetStatusHistory(t.Ctx, t.Vars["id"])
-	if err != nil {
-		return err
-	}
+	var (
+		edits   []*masta.StatusHistory
+		current *masta.Status
+	)
 
-	current, err := t.GetStatus(t.Ctx, t.Vars["id"])
+	err := t.parallel(
+		func(ctx context.Context) (err error) {
+			edits, err = t.GetStatusHistory(ctx, t.Vars["id"])
+			return
+		},
+		func(ctx context.Context) (err error) {
+			current, err = t.GetStatus(ctx, t.Vars["id"])
+			return
+		},
+	)
 	if err != nil {
 		return err
 	}
@@ -402,18 +630,46 @@ func handleEdits(t *Transaction) error {
 
 func init() { reg(handleNotifications, http.MethodGet, "/notifications") }
 func handleNotifications(t *Transaction) error {
-	q := t.R.URL.Query()
-	pg := masta.Pagination{
-		MaxID: q.Get("max_id"),
-		MinID: q.Get("min_id"),
-		Limit: conf.MaxPagination,
+	p := newPager(t)
+	only := t.Qry["type"]
+	notifs, err := getNotifications(t, &p.pg, only)
+	if err != nil {
+		return err
+	}
+
+	var first, last string
+	if len(notifs) > 0 {
+		first, last = notifs[0].ID, notifs[len(notifs)-1].ID
 	}
 
+	loadFilters(t)
+	return render.NotificationPage(t.Rctx, notifs, only, p.links(len(notifs), first, last))
+}
+
+// notificationTypes are the types shown by each notification filter.
+var notificationTypes = map[string][]string{
+	"mentions":   {"mention"},
+	"follows":    {"follow", "follow_request"},
+	"favourites": {"favourite"},
+	"reblogs":    {"reblog"},
+	"reactions":  {"pleroma:emoji_reaction"},
+}
+
+// allNotificationTypes are the types known to be sent by instances. When
+// an instance can't be asked to include only some types, the others are
+// excluded instead.
+var allNotificationTypes = []string{
+	"follow", "follow_request", "mention", "reblog", "favourite", "poll",
+	"status", "update", "move", "admin.sign_up", "admin.report",
+	"pleroma:emoji_reaction", "pleroma:chat_mention", "pleroma:report",
+}
+
+// getNotifications fetches the notifications shown by the filter only,
+// or all of them if it's empty.
+func getNotifications(t *Transaction, pg *masta.Pagination, only string) ([]*masta.Notification, error) {
 	var filter masta.NotificationFilter
-	if t.Session.Settings.HideUnsupportedNotifs {
+	if t.Session.Settings.HideUnsupportedNotifs && t.Caps.SupportsIncludeTypes {
 		// Explicitly include the supported types.
-		// For now, only Pleroma supports this option, Mastadon
-		// will simply ignore the unknown params.
 		filter.Include = []string{"follow", "follow_request", "mention", "reblog", "favourite", "pleroma:emoji_reaction"}
 	}
 
@@ -421,12 +677,24 @@ func handleNotifications(t *Transaction) error {
 		filter.Exclude = []string{"follow", "favourite", "reblog"}
 	}
 
-	notifs, err := t.GetNotificationsOf(t.Ctx, filter, &pg)
-	if err != nil {
-		return err
+	if only != "" {
+		types, ok := notificationTypes[only]
+		if !ok {
+			return nil, errInvalidArgument
+		}
+
+		if t.Caps.SupportsIncludeTypes {
+			filter.Include = types
+		} else {
+			for _, v := range allNotificationTypes {
+				if !slices.Contains(types, v) {
+					filter.Exclude = append(filter.Exclude, v)
+				}
+			}
+		}
 	}
 
-	return render.NotificationPage(t.Rctx, notifs)
+	return t.GetNotificationsOf(t.Ctx, filter, pg)
 }
 
 func init() { reg(handleUser, http.MethodGet, "/user/:id") }
@@ -438,14 +706,8 @@ func handleUser(t *Transaction) error {
 	id := t.Vars["id"]
 	pageType := t.Vars["type"]
 
-	maxID := t.Qry["max_id"]
-	minID := t.Qry["min_id"]
-
-	pg := masta.Pagination{
-		MaxID: maxID,
-		MinID: minID,
-		Limit: conf.MaxPagination,
-	}
+	p := newPager(t)
+	pg := &p.pg
 
 	var isAccounts bool
 
@@ -460,21 +722,21 @@ func handleUser(t *Transaction) error {
 	switch pageType {
 	case "":
 		statuses, err = t.GetAcctStatuses(t.Ctx, id, masta.AcctStatusOpts{
-			Pagination: &pg,
+			Pagination: pg,
 		})
 		if err != nil {
 			return err
 		}
 	case "following":
 		rPageType = render.UserPageFollowing
-		users, err = t.GetAccountFollowing(t.Ctx, id, &pg)
+		users, err = t.GetAccountFollowing(t.Ctx, id, pg)
 		if err != nil {
 			return err
 		}
 		isAccounts = true
 	case "followers":
 		rPageType = render.UserPageFollowers
-		users, err = t.GetAccountFollowers(t.Ctx, id, &pg)
+		users, err = t.GetAccountFollowers(t.Ctx, id, pg)
 		if err != nil {
 			return err
 		}
@@ -489,7 +751,7 @@ func handleUser(t *Transaction) error {
 		rPageType = render.UserPageMedia
 		statuses, err = t.GetAcctStatuses(t.Ctx, id, masta.AcctStatusOpts{
 			OnlyMedia:  true,
-			Pagination: &pg,
+			Pagination: pg,
 		})
 		if err != nil {
 			return err
@@ -498,19 +760,19 @@ func handleUser(t *Transaction) error {
 		selected = false
 	}
 
-	if !selected && t.Session.UserID != rel.ID {
+	if !selected && t.Session.UserID() != rel.ID {
 		return errInvalidArgument
 	} else if !selected {
 		switch pageType {
 		case "bookmarks":
 			rPageType = render.UserPageBookmarks
-			statuses, err = t.GetBookmarks(t.Ctx, &pg)
+			statuses, err = t.GetBookmarks(t.Ctx, pg)
 			if err != nil {
 				return err
 			}
 		case "mutes":
 			rPageType = render.UserPageMutes
-			users, err = t.GetMutes(t.Ctx, &pg)
+			users, err = t.GetMutes(t.Ctx, pg)
 			if err != nil {
 				return err
 			}
@@ -518,20 +780,20 @@ func handleUser(t *Transaction) error {
 
 		case "blocks":
 			rPageType = render.UserPageBlocks
-			users, err = t.GetBlocks(t.Ctx, &pg)
+			users, err = t.GetBlocks(t.Ctx, pg)
 			if err != nil {
 				return err
 			}
 			isAccounts = true
 		case "likes":
 			rPageType = render.UserPageLikes
-			statuses, err = t.GetFavourites(t.Ctx, &pg)
+			statuses, err = t.GetFavourites(t.Ctx, pg)
 			if err != nil {
 				return err
 			}
 		case "requests":
 			rPageType = render.UserPageRequests
-			users, err = t.GetFollowRequests(t.Ctx, &pg)
+			users, err = t.GetFollowRequests(t.Ctx, pg)
 			if err != nil {
 				return err
 			}
@@ -541,15 +803,18 @@ func handleUser(t *Transaction) error {
 		}
 	}
 
-	if rPageType != render.UserPagePinned {
-		t.Rctx.Pagination = &pg
+	if isAccounts {
+		return render.UserPage(t.Rctx, acct, rel, users, rPageType, accountLinks(p, users))
 	}
 
-	if isAccounts {
-		return render.UserPage(t.Rctx, acct, rel, users, rPageType)
+	// Pinned statuses all come at once.
+	var links render.Pager
+	if rPageType != render.UserPagePinned {
+		links = statusLinks(p, statuses)
 	}
 
-	return render.UserPage(t.Rctx, acct, rel, statuses, rPageType)
+	loadFilters(t)
+	return render.UserPage(t.Rctx, acct, rel, statuses, rPageType, links)
 }
 
 func init() { reg(handleUserSearch, http.MethodGet, "/usersearch/:id") }
@@ -557,7 +822,7 @@ func handleUserSearch(t *Transaction) error {
 	id := t.Vars["id"]
 	q := t.R.URL.Query()
 	sq := q.Get("q")
-	offset, _ := strconv.Atoi(q.Get("offset"))
+	p := newOffsetPager(t)
 
 	user, err := t.GetAccount(t.Ctx, id)
 	if err != nil {
@@ -568,13 +833,11 @@ func handleUserSearch(t *Transaction) error {
 	if len(q) > 0 {
 		results, err = t.DoSearch(t.Ctx, sq,
 			masta.SearchOpts{
-				Type:      "statuses",
-				Resolve:   true,
-				Offset:    offset,
-				AccountID: id,
-				Pagination: &masta.Pagination{
-					Limit: conf.MaxPagination,
-				},
+				Type:       "statuses",
+				Resolve:    true,
+				Offset:     p.offset,
+				AccountID:  id,
+				Pagination: &p.pg,
 			},
 		)
 		if err != nil {
@@ -584,7 +847,7 @@ func handleUserSearch(t *Transaction) error {
 		results = &masta.Results{}
 	}
 
-	return render.UserSearchPage(t.Rctx, offset, results, user, sq)
+	return render.UserSearchPage(t.Rctx, results, user, sq, p.links(len(results.Statuses)))
 }
 
 func init() { reg(handleAbout, http.MethodGet, "/about") }
@@ -602,25 +865,98 @@ func handleEmojis(t *Transaction) error {
 	return render.EmojiPage(t.Rctx, emojis)
 }
 
+func init() { reg(handleMediaProxy, http.MethodGet, "/media/proxy", noAuth, noType) }
+func handleMediaProxy(t *Transaction) error {
+	if t.proxy == nil {
+		t.W.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	u := t.Qry["url"]
+	var height int
+	if h := t.Qry["h"]; h != "" {
+		var err error
+		height, err = strconv.Atoi(h)
+		if err != nil || height < 0 {
+			t.W.WriteHeader(http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	if !t.proxy.valid(u, height, t.Qry["sig"]) {
+		t.W.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	ctx := t.Ctx
+	if t.Conf.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Conf.RequestTimeout)
+		defer cancel()
+	}
+
+	// Media has a client of its own, but its requests are still counted.
+	client := *t.proxy.client
+	client.Transport = t.stats.Transport(client.Transport)
+
+	ctype, data, modified, err := t.proxy.get(ctx, &client, t.Conf.UserAgent, u, height)
+	if err != nil {
+		// The page showing it is already loaded, so there's no
+		// point in an error page.
+		t.log.Warn("error proxying media", "url", u, "err", err)
+		t.W.WriteHeader(http.StatusBadGateway)
+		return nil
+	}
+
+	h := t.W.Header()
+	h.Set("Content-Type", ctype)
+	h.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(t.Conf.MediaCacheAge.Seconds())))
+	h.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	// ServeContent handles ranges, which audio and video players use.
+	http.ServeContent(t.W, t.R, "", modified, bytes.NewReader(data))
+	return nil
+}
+
+func init() { reg(handleMetrics, http.MethodGet, "/metrics", noAuth, noType) }
+func handleMetrics(t *Transaction) error {
+	if !t.Conf.Metrics {
+		t.W.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	if t.Conf.MetricsToken != "" {
+		token, ok := strings.CutPrefix(t.R.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(t.Conf.MetricsToken)) != 1 {
+			t.W.WriteHeader(http.StatusUnauthorized)
+			return nil
+		}
+	}
+
+	t.W.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	t.W.Header().Set("Cache-Control", "no-store")
+	t.metrics.write(t.W)
+	return nil
+}
+
 func init() { reg(handleSearch, http.MethodGet, "/search") }
 func handleSearch(t *Transaction) error {
 	q := t.R.URL.Query()
 	sq := q.Get("q")
 	qType := q.Get("type")
-	offset, _ := strconv.Atoi(q.Get("offset"))
+	p := newOffsetPager(t)
 
 	var results *masta.Results
 	if len(q) > 0 {
 		var err error
 		results, err = t.DoSearch(t.Ctx, sq,
 			masta.SearchOpts{
-				Type:      qType,
-				Resolve:   true,
-				Offset:    offset,
-				Following: false,
-				Pagination: &masta.Pagination{
-					Limit: 20,
-				},
+				Type:       qType,
+				Resolve:    true,
+				Offset:     p.offset,
+				Following:  false,
+				Pagination: &p.pg,
 			},
 		)
 		if err != nil {
@@ -630,17 +966,25 @@ func handleSearch(t *Transaction) error {
 		results = &masta.Results{}
 	}
 
-	return render.SearchPage(t.Rctx, results, sq, qType, offset)
+	var n int
+	switch qType {
+	case "accounts":
+		n = len(results.Accounts)
+	case "statuses":
+		n = len(results.Statuses)
+	}
+
+	return render.SearchPage(t.Rctx, results, sq, qType, p.links(n))
 }
 
 func init() { reg(handleSettings, http.MethodGet, "/settings") }
 func handleSettings(t *Transaction) error {
-	return render.SettingsPage(t.Rctx)
+	return render.SettingsPage(t.Rctx, t.feedToken())
 }
 
 func init() { reg(handleFilters, http.MethodGet, "/filters") }
 func handleFilters(t *Transaction) error {
-	filters, err := t.GetFilters(t.Ctx)
+	filters, err := t.getFilters(t.Ctx)
 	if err != nil {
 		return err
 	}
@@ -651,16 +995,7 @@ func handleFilters(t *Transaction) error {
 func init() { reg(handleSigninPost, http.MethodPost, "/signin", noAuth, noCSRF) }
 func handleSigninPost(t *Transaction) error {
 	instance := t.R.FormValue("instance")
-
-	url, sess, err := newSession(t, instance)
-	if err != nil {
-		return err
-	}
-
-	t.setSession(sess)
-	t.redirect(url)
-
-	return nil
+	return beginSignin(t, instance)
 }
 
 func init() { reg(handleOAuthCallback, http.MethodGet, "/oauth_callback", noAuth, noCSRF) }
@@ -671,18 +1006,19 @@ func handleOAuthCallback(t *Transaction) error {
 		return errInvalidArgument
 	}
 
-	mclient := masta.NewClient(&masta.Config{
-		Server:       "https://" + t.Session.Instance,
-		ClientID:     t.Session.ClientID,
-		ClientSecret: t.Session.ClientSecret,
-	})
-	mclient.Client = *t.h
-	mclient.UserAgent = t.Conf.UserAgent
+	ident := t.Session.Pending
+	if ident == nil {
+		return errInvalidSession
+	}
 
-	t.Client = mclient
+	t.useIdentity(ident)
 
 	err := t.AuthenticateToken(t.Ctx, code, t.Conf.ClientWebsite+"/oauth_callback")
 	if err != nil {
+		var me *masta.APIError
+		if errors.As(err, &me) && me.Code == http.StatusUnauthorized {
+			t.rejectedApp(ident)
+		}
 		return err
 	}
 
@@ -691,10 +1027,23 @@ func handleOAuthCallback(t *Transaction) error {
 		return err
 	}
 
-	t.Session.UserID = u.ID
-	t.Session.AccessToken = t.Client.Config.AccessToken
+	ident.UserID = u.ID
+	ident.Acct = u.Acct + "@" + accountDomain(u, ident.Instance)
+	ident.AccessToken = t.Client.Config.AccessToken
 
-	err = t.setSession(t.Session)
+	// Signing in to an account that's already there refreshes its token.
+	idents := t.Session.Identities[:0]
+	for _, v := range t.Session.Identities {
+		if v.UserID != ident.UserID || v.Instance != ident.Instance {
+			idents = append(idents, v)
+		}
+	}
+
+	t.Session.Identities = append(idents, ident)
+	t.Session.Active = ident.ID
+	t.Session.Pending = nil
+
+	err = t.setSession(t.Session)
 	if err != nil {
 		return err
 	}
@@ -704,7 +1053,7 @@ func handleOAuthCallback(t *Transaction) error {
 }
 
 func init() { reg(handlePost, http.MethodPost, "/post") }
-func handlePost(t *Transaction) error {
+func handlePost(t *Transaction) (err error) {
 	content := t.R.FormValue("content")
 	replyToID := t.R.FormValue("reply_to_id")
 	format := t.R.FormValue("format")
@@ -712,20 +1061,42 @@ func handlePost(t *Transaction) error {
 	subjectHeader := t.R.FormValue("subject")
 	isNSFW := t.R.FormValue("is_nsfw") == "true"
 	quickReply := t.R.FormValue("quickreply") == "true"
-	files := t.R.MultipartForm.File["attachments"]
+	scheduledAt := t.R.FormValue("scheduled_at")
+	quoteID := t.R.FormValue("quote_id")
+
+	if !t.Caps.SupportsContentType(format) {
+		format = ""
+	}
 
-	var mediaIDs []string
-	for _, f := range files {
-		var reader io.Reader
-		reader, err := f.Open()
+	// Attachments of a resumed draft are already uploaded.
+	mediaIDs := t.R.Form["media_ids"]
+
+	defer func() {
 		if err != nil {
-			return err
+			err = t.captureDraft(mediaIDs, err)
 		}
-		a, err := t.UploadMediaFromReader(t.Ctx, reader)
+	}()
+
+	if len(quoteID) > 0 && !t.Caps.SupportsQuotes {
+		return errUnsupported
+	}
+
+	var at time.Time
+	if len(scheduledAt) > 0 {
+		at, err = parseLocalTime(scheduledAt, t.Session.Settings.Location())
 		if err != nil {
-			return err
+			return errInvalidArgument
 		}
-		mediaIDs = append(mediaIDs, a.ID)
+	}
+
+	atts, err := t.attachmentsFromForm()
+	if err != nil {
+		return err
+	}
+
+	mediaIDs, err = t.upload(mediaIDs, atts)
+	if err != nil {
+		return err
 	}
 
 	tweet := &masta.Toot{
@@ -738,13 +1109,35 @@ func handlePost(t *Transaction) error {
 		Sensitive:   isNSFW,
 	}
 
-	st, err := t.PostStatus(t.Ctx, tweet)
+	if !at.IsZero() {
+		_, err := t.Up.PostScheduledStatus(t.Ctx, tweet, at, t.Caps.QuoteParams(quoteID))
+		if err != nil {
+			return err
+		}
+
+		t.postedDraft()
+		t.postedUploads(mediaIDs)
+		t.redirect("/scheduled")
+		return nil
+	}
+
+	var st *masta.Status
+	if len(quoteID) > 0 {
+		st, err = t.Up.PostStatus(t.Ctx, tweet, t.Caps.QuoteParams(quoteID))
+	} else {
+		st, err = t.PostStatus(t.Ctx, tweet)
+	}
 	if err != nil {
 		return err
 	}
 
+	t.postedDraft()
+	t.postedUploads(mediaIDs)
+
 	var location string
-	if len(replyToID) > 0 {
+	if len(quoteID) > 0 {
+		location = "/thread/" + st.ID + "#status-" + st.ID
+	} else if len(replyToID) > 0 {
 		if quickReply {
 			location = "/quickreply/" + st.ID + "#status-" + st.ID
 		} else {
@@ -758,7 +1151,7 @@ func handlePost(t *Transaction) error {
 }
 
 func init() { reg(handleEdit, http.MethodPost, "/edit") }
-func handleEdit(t *Transaction) error {
+func handleEdit(t *Transaction) (err error) {
 	originalID := t.R.FormValue("id")
 	content := t.R.FormValue("content")
 	replyToID := t.R.FormValue("reply_to_id")
@@ -766,24 +1159,29 @@ func handleEdit(t *Transaction) error {
 	visibility := t.R.FormValue("visibility")
 	subjectHeader := t.R.FormValue("subject")
 	isNSFW := t.R.FormValue("is_nsfw") == "true"
-	files := t.R.MultipartForm.File["attachments"]
 	alt := t.R.Form["alt_text"]
 	mediaIDs := t.R.Form["media_ids"]
 
+	if !t.Caps.SupportsContentType(format) {
+		format = ""
+	}
+
+	defer func() {
+		if err != nil {
+			err = t.captureDraft(mediaIDs, err)
+		}
+	}()
+
+	atts, err := t.attachmentsFromForm()
+	if err != nil {
+		return err
+	}
+
 	var editedAttachments []masta.MediaAttribute
-	if len(files) != 0 {
-		mediaIDs = []string{}
-		for _, f := range files {
-			var reader io.Reader
-			reader, err := f.Open()
-			if err != nil {
-				return err
-			}
-			a, err := t.UploadMediaFromReader(t.Ctx, reader)
-			if err != nil {
-				return err
-			}
-			mediaIDs = append(mediaIDs, a.ID)
+	if len(atts) != 0 {
+		mediaIDs, err = t.upload([]string{}, atts)
+		if err != nil {
+			return err
 		}
 	} else if len(alt) <= len(mediaIDs) {
 		for i, v := range alt {
@@ -806,11 +1204,13 @@ func handleEdit(t *Transaction) error {
 		Sensitive:           isNSFW,
 	}
 
-	_, err := t.CompatUpdateStatus(t.Ctx, tweet, originalID)
+	_, err = t.CompatUpdateStatus(t.Ctx, tweet, originalID)
 	if err != nil {
 		return err
 	}
 
+	t.postedDraft()
+	t.postedUploads(mediaIDs)
 	t.redirect("/thread/" + originalID + "#post-" + originalID)
 	return nil
 }
@@ -913,6 +1313,7 @@ func handleFollow(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -924,6 +1325,7 @@ func handleUnfollow(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -935,6 +1337,7 @@ func handleAccept(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -946,6 +1349,7 @@ func handleReject(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -978,6 +1382,7 @@ func handleMutePost(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect("/user/" + t.Vars["id"])
 	return nil
@@ -989,6 +1394,7 @@ func handleUnmute(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -1000,6 +1406,7 @@ func handleBlock(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -1011,6 +1418,7 @@ func handleUnblock(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -1018,10 +1426,15 @@ func handleUnblock(t *Transaction) error {
 
 func init() { reg(handleSubscribe, http.MethodPost, "/subscribe/:id") }
 func handleSubscribe(t *Transaction) error {
+	if !t.Caps.SupportsSubscriptions {
+		return errUnsupported
+	}
+
 	_, err := t.PlAccountSubscribe(t.Ctx, t.Vars["id"])
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -1029,10 +1442,15 @@ func handleSubscribe(t *Transaction) error {
 
 func init() { reg(handleUnsubscribe, http.MethodPost, "/unsubscribe/:id") }
 func handleUnsubscribe(t *Transaction) error {
+	if !t.Caps.SupportsSubscriptions {
+		return errUnsupported
+	}
+
 	_, err := t.PlAccountUnsubscribe(t.Ctx, t.Vars["id"])
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -1051,6 +1469,7 @@ func handleRemoveFollower(t *Transaction) error {
 		}
 		return err
 	}
+	t.invalidateAccount(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -1062,6 +1481,7 @@ func handleSetSettings(t *Transaction) error {
 	format := t.R.FormValue("format")
 	copyScope := t.R.FormValue("copy_scope") == "true"
 	threadInNewTab := t.R.FormValue("thread_in_new_tab") == "true"
+	threadTree := t.R.FormValue("thread_tree") == "true"
 	hideAttachments := t.R.FormValue("hide_attachments") == "true"
 	maskNSFW := t.R.FormValue("mask_nsfw") == "true"
 	ni, _ := strconv.Atoi(t.R.FormValue("notification_interval"))
@@ -1072,6 +1492,21 @@ func handleSetSettings(t *Transaction) error {
 	css := t.R.FormValue("css")
 	themeCSS := t.R.FormValue("theme-css")
 	themeCSSTarget := t.R.FormValue("theme-css-target")
+	timeZone := t.R.FormValue("time_zone")
+
+	if _, err := time.LoadLocation(timeZone); err != nil {
+		return errInvalidArgument
+	}
+
+	// Left empty, the default is used.
+	var pageSize int
+	if v := t.R.FormValue("page_size"); v != "" {
+		var err error
+		pageSize, err = strconv.Atoi(v)
+		if err != nil || pageSize < 1 || pageSize > t.Conf.MaxPageSize {
+			return errInvalidArgument
+		}
+	}
 
 	if _, ok := render.LookupTheme(theme); !ok {
 		theme = conf.DefaultTheme
@@ -1093,6 +1528,7 @@ func handleSetSettings(t *Transaction) error {
 		DefaultFormat:         format,
 		CopyScope:             copyScope,
 		ThreadInNewTab:        threadInNewTab,
+		ThreadTree:            threadTree,
 		HideAttachments:       hideAttachments,
 		MaskNSFW:              maskNSFW,
 		NotificationInterval:  ni,
@@ -1102,11 +1538,12 @@ func handleSetSettings(t *Transaction) error {
 		HideUnsupportedNotifs: hideUnsupportedNotifs,
 		CSS:                   css,
 		ThemeCSS:              sessionTCSS,
+		TimeZone:              timeZone,
+		Rules:                 t.Session.Settings.Rules,
+		PageSize:              pageSize,
 		Stamp:                 t.sfnode.Generate().String(),
 	}
 
-	fmt.Println(settings)
-
 	switch settings.NotificationInterval {
 	case 0, 30, 60, 120, 300, 600:
 	default:
@@ -1161,6 +1598,10 @@ func handleDelete(t *Transaction) error {
 
 func init() { reg(handleReadNotifications, http.MethodPost, "/notifications/read") }
 func handleReadNotifications(t *Transaction) error {
+	if !t.Caps.SupportsMarkRead {
+		return errUnsupported
+	}
+
 	err := t.PlReadNotificationsTo(t.Ctx, t.Qry["max_id"])
 	if err != nil {
 		return err
@@ -1170,6 +1611,38 @@ func handleReadNotifications(t *Transaction) error {
 	return nil
 }
 
+func init() { reg(handleReact, http.MethodPost, "/react/:id/:emoji") }
+func handleReact(t *Transaction) error {
+	if !t.Caps.SupportsReactions {
+		return errUnsupported
+	}
+
+	id := t.Vars["id"]
+	_, err := t.Up.React(t.Ctx, id, t.Vars["emoji"])
+	if err != nil {
+		return err
+	}
+
+	t.redirect(t.R.FormValue("referrer") + "#status-" + id)
+	return nil
+}
+
+func init() { reg(handleUnreact, http.MethodPost, "/unreact/:id/:emoji") }
+func handleUnreact(t *Transaction) error {
+	if !t.Caps.SupportsReactions {
+		return errUnsupported
+	}
+
+	id := t.Vars["id"]
+	_, err := t.Up.Unreact(t.Ctx, id, t.Vars["emoji"])
+	if err != nil {
+		return err
+	}
+
+	t.redirect(t.R.FormValue("referrer") + "#status-" + id)
+	return nil
+}
+
 func init() { reg(handleBookmark, http.MethodPost, "/bookmark/:id") }
 func handleBookmark(t *Transaction) error {
 	id := t.Vars["id"]
@@ -1309,6 +1782,7 @@ func handleProfilePage(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateAccount(t.Session.UserID())
 
 	t.redirect("/profile")
 	return nil
@@ -1354,24 +1828,147 @@ func handleUnpin(t *Transaction) error {
 
 func init() { reg(handleFilter, http.MethodPost, "/filter") }
 func handleFilter(t *Transaction) error {
-	filter := &masta.Filter{
-		Context:   []string{"home", "notifications", "public", "thread"},
-		Phrase:    t.R.FormValue("phrase"),
-		WholeWord: t.R.FormValue("whole_word") == "true",
+	var keywords []string
+	for _, v := range strings.Split(t.R.FormValue("keywords"), "\n") {
+		if v = strings.TrimSpace(v); v != "" {
+			keywords = append(keywords, v)
+		}
+	}
+
+	contexts := t.R.PostForm["context"]
+	if len(keywords) == 0 || len(contexts) == 0 {
+		return errInvalidArgument
+	}
+	for _, v := range contexts {
+		if !slices.Contains(upstream.FilterContexts, v) {
+			return errInvalidArgument
+		}
+	}
+
+	action := t.R.FormValue("action")
+	if action != upstream.FilterWarn && action != upstream.FilterHide {
+		return errInvalidArgument
+	}
+
+	var expiresIn time.Duration
+	if v := t.R.FormValue("expires_in"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			return errInvalidArgument
+		}
+		expiresIn = time.Duration(secs) * time.Second
 	}
 
-	_, err := t.CreateFilter(t.Ctx, filter)
+	wholeWord := t.R.FormValue("whole_word") == "true"
+
+	err := createFilter(t, t.R.FormValue("title"), keywords, wholeWord, contexts, action, expiresIn)
 	if err != nil {
 		return err
 	}
 
+	t.invalidate("filters")
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
 }
 
+// createFilter creates a filter of the keywords, named after the first
+// if there's no title. Instances without filters v2 get a filter for
+// each keyword, which they can't name, and only hide what's filtered if
+// it's irreversible.
+func createFilter(t *Transaction, title string, keywords []string, wholeWord bool, contexts []string, action string, expiresIn time.Duration) error {
+	if t.Caps.SupportsFiltersV2 {
+		if title == "" {
+			title = keywords[0]
+		}
+
+		filter := &upstream.Filter{
+			Title:   title,
+			Context: contexts,
+			Action:  action,
+		}
+		for _, v := range keywords {
+			filter.Keywords = append(filter.Keywords, upstream.FilterKeyword{Keyword: v, WholeWord: wholeWord})
+		}
+
+		_, err := t.Up.CreateFilter(t.Ctx, filter, expiresIn)
+		return err
+	}
+
+	var expiresAt time.Time
+	if expiresIn > 0 {
+		expiresAt = time.Now().Add(expiresIn)
+	}
+
+	for _, v := range keywords {
+		_, err := t.CreateFilter(t.Ctx, &masta.Filter{
+			Phrase:       v,
+			Context:      contexts,
+			WholeWord:    wholeWord,
+			ExpiresAt:    expiresAt,
+			Irreversible: action == upstream.FilterHide,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() { reg(handleUnfilter, http.MethodPost, "/unfilter/:id") }
 func handleUnfilter(t *Transaction) error {
-	err := t.DeleteFilter(t.Ctx, t.Vars["id"])
+	var err error
+	if t.Caps.SupportsFiltersV2 {
+		err = t.Up.DeleteFilter(t.Ctx, t.Vars["id"])
+	} else {
+		err = t.DeleteFilter(t.Ctx, t.Vars["id"])
+	}
+	if err != nil {
+		return err
+	}
+
+	t.invalidate("filters")
+
+	t.redirect(t.R.FormValue("referrer"))
+	return nil
+}
+
+func init() { reg(handleRules, http.MethodGet, "/rules") }
+func handleRules(t *Transaction) error {
+	lists, err := t.GetLists(t.Ctx)
+	if err != nil {
+		return err
+	}
+
+	return render.RulesPage(t.Rctx, t.Session.Settings.Rules, lists)
+}
+
+func init() { reg(handleRule, http.MethodPost, "/rule") }
+func handleRule(t *Transaction) error {
+	if len(t.Session.Settings.Rules) >= maxRules {
+		return errInvalidArgument
+	}
+
+	rule, err := t.ruleFromForm()
+	if err != nil {
+		return err
+	}
+
+	t.Session.Settings.Rules = append(slices.Clip(t.Session.Settings.Rules), *rule)
+	err = t.setSession(t.Session)
+	if err != nil {
+		return err
+	}
+
+	t.redirect(t.R.FormValue("referrer"))
+	return nil
+}
+
+func init() { reg(handleUnrule, http.MethodPost, "/unrule/:id") }
+func handleUnrule(t *Transaction) error {
+	t.Session.Settings.Rules = slices.DeleteFunc(slices.Clone(t.Session.Settings.Rules), func(r render.Rule) bool {
+		return r.ID == t.Vars["id"]
+	})
+	err := t.setSession(t.Session)
 	if err != nil {
 		return err
 	}
@@ -1390,6 +1987,55 @@ func handleLists(t *Transaction) error {
 	return render.ListsPage(t.Rctx, lists)
 }
 
+func init() { reg(handleTags, http.MethodGet, "/tags") }
+func handleTags(t *Transaction) error {
+	if tag := strings.TrimPrefix(strings.TrimSpace(t.Qry["tag"]), "#"); tag != "" {
+		t.redirect("/timeline/tag/" + url.PathEscape(tag))
+		return nil
+	}
+
+	var tags []*upstream.Tag
+	if t.Caps.SupportsFollowTags {
+		var err error
+		tags, err = t.Up.GetFollowedTags(t.Ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return render.TagsPage(t.Rctx, tags)
+}
+
+func init() { reg(handleFollowTag, http.MethodPost, "/tag/:name/follow") }
+func handleFollowTag(t *Transaction) error {
+	if !t.Caps.SupportsFollowTags {
+		return errUnsupported
+	}
+
+	err := t.Up.FollowTag(t.Ctx, t.Vars["name"])
+	if err != nil {
+		return err
+	}
+
+	t.redirect(t.R.FormValue("referrer"))
+	return nil
+}
+
+func init() { reg(handleUnfollowTag, http.MethodPost, "/tag/:name/unfollow") }
+func handleUnfollowTag(t *Transaction) error {
+	if !t.Caps.SupportsFollowTags {
+		return errUnsupported
+	}
+
+	err := t.Up.UnfollowTag(t.Ctx, t.Vars["name"])
+	if err != nil {
+		return err
+	}
+
+	t.redirect(t.R.FormValue("referrer"))
+	return nil
+}
+
 func init() { reg(handleAddList, http.MethodPost, "/list") }
 func handleAddList(t *Transaction) error {
 	title := t.R.FormValue("title")
@@ -1398,6 +2044,7 @@ func handleAddList(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidate("lists")
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -1409,6 +2056,7 @@ func handleRemoveList(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateList(t.Vars["id"])
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
 }
@@ -1421,6 +2069,7 @@ func handleRenameList(t *Transaction) error {
 	if err != nil {
 		return err
 	}
+	t.invalidateList(t.Vars["id"])
 
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
@@ -1430,12 +2079,43 @@ func init() { reg(handleList, http.MethodGet, "/list/:id") }
 func handleList(t *Transaction) error {
 	id := t.Vars["id"]
 	q := t.Qry["q"]
+	p := newPager(t)
+
+	var (
+		list           *masta.List
+		accounts       []*masta.Account
+		following      []*masta.Account
+		members        []*masta.Account
+		fetchFollowing func(ctx context.Context) error
+		fetchMembers   func(ctx context.Context) error
+	)
 
-	list, err := t.GetList(t.Ctx, id)
-	if err != nil {
-		return err
+	// Searching is done by ourselves, since Mastodon doesn't support
+	// filtering searches down to followers. Those already in the list
+	// are left out, not only those on this page of it.
+	if len(q) > 0 {
+		fetchFollowing = func(ctx context.Context) (err error) {
+			following, err = t.GetAccountFollowing(ctx, t.Session.UserID(), nil)
+			return
+		}
+		fetchMembers = func(ctx context.Context) (err error) {
+			members, err = t.Up.GetAllListAccounts(ctx, id)
+			return
+		}
 	}
-	accounts, err := t.GetListAccounts(t.Ctx, id)
+
+	err := t.parallel(
+		func(ctx context.Context) (err error) {
+			list, err = t.GetList(ctx, id)
+			return
+		},
+		func(ctx context.Context) (err error) {
+			accounts, err = t.Up.GetListAccounts(ctx, id, &p.pg)
+			return
+		},
+		fetchFollowing,
+		fetchMembers,
+	)
 	if err != nil {
 		return err
 	}
@@ -1444,23 +2124,17 @@ func handleList(t *Transaction) error {
 		List:     list,
 		Accounts: accounts,
 		Q:        q,
+		Pager:    accountLinks(p, accounts),
 	}
 
 	if len(q) > 0 {
 		data.SearchAccounts = []*masta.Account{}
 
-		// Do it ourselves, since Mastodon doesn't support filtering searches down
-		// to followers.
-		following, err := t.GetAccountFollowing(t.Ctx, t.Session.UserID, nil)
-		if err != nil {
-			return err
-		}
-
 		lowq := strings.ToLower(q)
 		for _, v := range following {
 			skip := false
 
-			for _, j := range accounts {
+			for _, j := range members {
 				if v.ID == j.ID {
 					skip = true
 					break
@@ -1493,7 +2167,6 @@ func handleListAddUser(t *Transaction) error {
 	if err != nil {
 		return err
 	}
-
 	t.redirect(t.R.FormValue("referrer"))
 	return nil
 }
@@ -1504,7 +2177,6 @@ func handleListRemoveUser(t *Transaction) error {
 	if err != nil {
 		return err
 	}
-
 	t.redirect(t.R.FormValue("referrer"))
 
 	return nil
@@ -1512,7 +2184,54 @@ func handleListRemoveUser(t *Transaction) error {
 
 func init() { reg(handleSignout, http.MethodPost, "/signout", noType) }
 func handleSignout(t *Transaction) error {
-	t.unsetSession()
+	err := t.removeIdentity(t.Session.Active)
+	if err != nil {
+		return err
+	}
+
+	t.redirect("/")
+	return nil
+}
+
+func init() { reg(handleAccounts, http.MethodGet, "/accounts") }
+func handleAccounts(t *Transaction) error {
+	return render.AccountsPage(t.Rctx, t.Session.accounts())
+}
+
+func init() { reg(handleAddAccount, http.MethodPost, "/accounts/add") }
+func handleAddAccount(t *Transaction) error {
+	instance, single := t.Conf.SingleInstance()
+	if !single {
+		instance = t.R.FormValue("instance")
+	}
+
+	return beginSignin(t, instance)
+}
+
+func init() { reg(handleSwitchAccount, http.MethodPost, "/accounts/switch") }
+func handleSwitchAccount(t *Transaction) error {
+	id := t.R.FormValue("id")
+	if t.Session.identity(id) == nil {
+		return errInvalidArgument
+	}
+
+	t.Session.Active = id
+	err := t.setSession(t.Session)
+	if err != nil {
+		return err
+	}
+
+	t.redirect("/")
+	return nil
+}
+
+func init() { reg(handleRemoveAccount, http.MethodPost, "/accounts/remove") }
+func handleRemoveAccount(t *Transaction) error {
+	err := t.removeIdentity(t.R.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
 	t.redirect("/")
 	return nil
 }
@@ -1551,6 +2270,36 @@ func handleFluorideUnretweet(t *Transaction) error {
 	return t.writeJson(count)
 }
 
+func init() { reg(handleFluorideReact, http.MethodPost, "/fluoride/react/:id/:emoji", noType) }
+func handleFluorideReact(t *Transaction) error {
+	t.W.Header().Set("Content-Type", "application/json")
+	if !t.Caps.SupportsReactions {
+		return errUnsupported
+	}
+
+	reactions, err := t.Up.React(t.Ctx, t.Vars["id"], t.Vars["emoji"])
+	if err != nil {
+		return err
+	}
+
+	return t.writeJson(reactions)
+}
+
+func init() { reg(handleFluorideUnreact, http.MethodPost, "/fluoride/unreact/:id/:emoji", noType) }
+func handleFluorideUnreact(t *Transaction) error {
+	t.W.Header().Set("Content-Type", "application/json")
+	if !t.Caps.SupportsReactions {
+		return errUnsupported
+	}
+
+	reactions, err := t.Up.Unreact(t.Ctx, t.Vars["id"], t.Vars["emoji"])
+	if err != nil {
+		return err
+	}
+
+	return t.writeJson(reactions)
+}
+
 func init() { reg(handleUserCSS, http.MethodGet, "/session/css", noType) }
 func handleUserCSS(t *Transaction) error {
 	stamp := t.Qry["stamp"]
@@ -1614,7 +2363,6 @@ func handleTheme(t *Transaction) error {
 	theme := t.Vars["name"]
 	_, ok := render.LookupTheme(theme)
 	if !ok {
-		fmt.Println("theme", theme)
 		t.W.WriteHeader(http.StatusNotFound)
 		return nil
 	}
@@ -1626,3 +2374,248 @@ func handleTheme(t *Transaction) error {
 
 	return render.RenderTheme(theme, *t.Conf, t.W)
 }
+
+func init() { reg(handleFeedTimeline, http.MethodGet, "/feed/timeline/:type", noAuth, noType) }
+func handleFeedTimeline(t *Transaction) error {
+	if err := t.authenticateFeed(); err != nil {
+		return err
+	}
+
+	tType := t.Vars["type"]
+	instance := t.Qry["instance"]
+	list := t.Qry["list"]
+
+	statuses, title, err := getTimeline(t, tType, instance, list, &masta.Pagination{
+		Limit: int64(t.pageSize()),
+	})
+	if err != nil {
+		return err
+	}
+
+	v := make(url.Values)
+	if len(instance) > 0 {
+		v.Set("instance", instance)
+	}
+	if len(list) > 0 {
+		v.Set("list", list)
+	}
+
+	return renderFeed(t, title, "/timeline/"+tType+"?"+v.Encode(), statuses, nil)
+}
+
+func init() { reg(handleFeedList, http.MethodGet, "/feed/list/:id", noAuth, noType) }
+func handleFeedList(t *Transaction) error {
+	if err := t.authenticateFeed(); err != nil {
+		return err
+	}
+
+	id := t.Vars["id"]
+	statuses, title, err := getTimeline(t, "list", "", id, &masta.Pagination{
+		Limit: int64(t.pageSize()),
+	})
+	if err != nil {
+		return err
+	}
+
+	return renderFeed(t, title, "/timeline/list?list="+url.QueryEscape(id), statuses, nil)
+}
+
+func init() { reg(handleFeedUser, http.MethodGet, "/feed/user/:id", noAuth, noType) }
+func handleFeedUser(t *Transaction) error {
+	if err := t.authenticateFeed(); err != nil {
+		return err
+	}
+
+	id := t.Vars["id"]
+	acct, err := t.GetAccount(t.Ctx, id)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := t.GetAcctStatuses(t.Ctx, id, masta.AcctStatusOpts{
+		Pagination: &masta.Pagination{
+			Limit: int64(t.pageSize()),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return renderFeed(t, "@"+acct.Acct, "/user/"+id, statuses, nil)
+}
+
+func init() { reg(handleFeedNotifications, http.MethodGet, "/feed/notifications", noAuth, noType) }
+func handleFeedNotifications(t *Transaction) error {
+	if err := t.authenticateFeed(); err != nil {
+		return err
+	}
+
+	notifs, err := getNotifications(t, &masta.Pagination{
+		Limit: int64(t.pageSize()),
+	}, "")
+	if err != nil {
+		return err
+	}
+
+	return renderFeed(t, "Notifications", "/notifications", nil, notifs)
+}
+
+func renderFeed(t *Transaction, title string, link string, statuses []*masta.Status, notifs []*masta.Notification) error {
+	base := t.Conf.ClientWebsite
+	format := t.Qry["format"]
+
+	entries := make([]render.FeedEntry, 0, len(statuses)+len(notifs))
+	for _, v := range statuses {
+		entries = append(entries, render.StatusEntry(base, v))
+	}
+	for _, v := range notifs {
+		entries = append(entries, render.NotificationEntry(base, v))
+	}
+
+	t.W.Header().Set("Content-Type", render.FeedContentType(format))
+	return render.FeedPage(t.Rctx, format, &render.FeedData{
+		Title:   title + " // 8bloat",
+		Link:    base + link,
+		Self:    base + t.R.URL.RequestURI(),
+		Entries: entries,
+	})
+}
+
+// accountDomain returns the domain of the signed-in account, taken from
+// its URL, since the API can be served from another host than the one
+// accounts are on.
+func accountDomain(u *masta.Account, instance string) string {
+	if pu, err := url.Parse(u.URL); err == nil && pu.Host != "" {
+		return pu.Host
+	}
+	return instance
+}
+
+func init() { reg(handleFeedToken, http.MethodPost, "/feed/token") }
+func handleFeedToken(t *Transaction) error {
+	ident := t.Session.Identity()
+	t.revokeFeedToken(ident)
+
+	token, err := NewRandID(32)
+	if err != nil {
+		return err
+	}
+
+	err = t.feeds.Put(token, &FeedLink{Session: t.Session.id, Identity: ident.ID})
+	if err != nil {
+		return err
+	}
+	ident.FeedToken = token
+
+	err = t.setSession(t.Session)
+	if err != nil {
+		return err
+	}
+
+	t.redirect("/settings")
+	return nil
+}
+
+func init() { reg(handleRevokeFeedToken, http.MethodPost, "/feed/token/revoke") }
+func handleRevokeFeedToken(t *Transaction) error {
+	t.revokeFeedToken(t.Session.Identity())
+
+	err := t.setSession(t.Session)
+	if err != nil {
+		return err
+	}
+
+	t.redirect("/settings")
+	return nil
+}
+
+// parseLocalTime parses the value of a datetime-local input, which has no
+// time zone of its own.
+func parseLocalTime(v string, loc *time.Location) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02T15:04", v, loc)
+}
+
+func init() { reg(handleScheduled, http.MethodGet, "/scheduled") }
+func handleScheduled(t *Transaction) error {
+	statuses, err := t.Up.GetScheduledStatuses(t.Ctx)
+	if err != nil {
+		return err
+	}
+
+	return render.ScheduledPage(t.Rctx, statuses)
+}
+
+func init() { reg(handleReschedule, http.MethodPost, "/scheduled/:id") }
+func handleReschedule(t *Transaction) error {
+	at, err := parseLocalTime(t.R.FormValue("scheduled_at"), t.Session.Settings.Location())
+	if err != nil {
+		return errInvalidArgument
+	}
+
+	_, err = t.Up.RescheduleStatus(t.Ctx, t.Vars["id"], at)
+	if err != nil {
+		return err
+	}
+
+	t.redirect("/scheduled")
+	return nil
+}
+
+func init() { reg(handleCancelScheduled, http.MethodPost, "/scheduled/:id/cancel") }
+func handleCancelScheduled(t *Transaction) error {
+	err := t.Up.CancelScheduledStatus(t.Ctx, t.Vars["id"])
+	if err != nil {
+		return err
+	}
+
+	t.redirect("/scheduled")
+	return nil
+}
+
+func init() { reg(handleDrafts, http.MethodGet, "/drafts") }
+func handleDrafts(t *Transaction) error {
+	drafts := t.Session.Identity().Drafts
+	data := make([]render.DraftData, len(drafts))
+	for i, v := range drafts {
+		data[i] = v.data()
+	}
+
+	return render.DraftsPage(t.Rctx, data)
+}
+
+func init() { reg(handleDraft, http.MethodGet, "/drafts/:id") }
+func handleDraft(t *Transaction) error {
+	d := t.draft(t.Vars["id"])
+	if d == nil {
+		return errInvalidArgument
+	}
+
+	return render.DraftPage(t.Rctx, d.data())
+}
+
+func init() { reg(handleSaveDraft, http.MethodPost, "/drafts") }
+func handleSaveDraft(t *Transaction) error {
+	d := t.draftFromForm()
+	if d.empty() {
+		return errInvalidArgument
+	}
+
+	err := t.saveDraft(d)
+	if err != nil {
+		return err
+	}
+
+	t.redirect(t.R.FormValue("referrer"))
+	return nil
+}
+
+func init() { reg(handleRemoveDraft, http.MethodPost, "/drafts/:id/remove") }
+func handleRemoveDraft(t *Transaction) error {
+	err := t.removeDraft(t.Vars["id"])
+	if err != nil {
+		return err
+	}
+
+	t.redirect("/drafts")
+	return nil
+}
@@ -0,0 +1,321 @@
+package service
+
+import (
+	"bytes"
+	"flag"
+	"html"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"spiderden.org/8bloat/internal/conf"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the pages rendered")
+
+const testWebsite = "http://bloat.test"
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	// Every request is logged at info, only problems are worth seeing.
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	os.Exit(m.Run())
+}
+
+func testConfig() conf.Configuration {
+	return conf.Configuration{
+		ListenAddress: "127.0.0.1:0",
+		ClientName:    "8bloat",
+		ClientScope:   "read write follow",
+		ClientWebsite: testWebsite,
+		PostFormats: []conf.PostFormat{
+			{Name: "Plain text", Type: "text/plain"},
+			{Name: "Markdown", Type: "text/markdown"},
+		},
+		AssetStamp:     "test",
+		UserAgent:      "8bloat-test",
+		ResponseLimit:  1 << 20,
+		RequestTimeout: 10 * time.Second,
+		MaxPageSize:    40,
+		SessionStore:   "memory",
+		SessionKey:     "0123456789abcdef0123456789abcdef",
+	}
+}
+
+// newTestService returns a service whose upstream requests go to inst.
+func newTestService(t *testing.T, inst *fakeInstance) *Service {
+	t.Helper()
+
+	s := &Service{}
+	if err := s.setup(testConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	st := s.state.Load()
+	st.client = &http.Client{
+		Transport: &tripper{underlying: inst.srv.Client().Transport, conf: st.cfg},
+		Timeout:   st.cfg.RequestTimeout,
+	}
+	return s
+}
+
+// testClient drives a service the way a browser would, keeping its
+// cookies and sending the CSRF token with forms.
+type testClient struct {
+	t    *testing.T
+	s    *Service
+	inst *fakeInstance
+	jar  http.CookieJar
+	csrf string
+}
+
+type response struct {
+	Code   int
+	Header http.Header
+	Body   string
+}
+
+func newTestClient(t *testing.T) *testClient {
+	t.Helper()
+
+	inst := newFakeInstance(t)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testClient{t: t, s: newTestService(t, inst), inst: inst, jar: jar}
+}
+
+// newSignedInClient returns a client that's signed in to the fake
+// instance.
+func newSignedInClient(t *testing.T) *testClient {
+	t.Helper()
+
+	c := newTestClient(t)
+	c.signin()
+	return c
+}
+
+func (c *testClient) do(r *http.Request) *response {
+	c.t.Helper()
+
+	u, _ := url.Parse(testWebsite)
+	for _, v := range c.jar.Cookies(u) {
+		r.AddCookie(v)
+	}
+
+	w := httptest.NewRecorder()
+	c.s.ServeHTTP(w, r)
+
+	res := w.Result()
+	c.jar.SetCookies(u, res.Cookies())
+	return &response{Code: res.StatusCode, Header: res.Header, Body: w.Body.String()}
+}
+
+func (c *testClient) get(path string) *response {
+	c.t.Helper()
+	return c.do(httptest.NewRequest(http.MethodGet, testWebsite+path, nil))
+}
+
+// post sends the form, along with the CSRF token if there is one.
+func (c *testClient) post(path string, form url.Values) *response {
+	c.t.Helper()
+
+	if form == nil {
+		form = url.Values{}
+	}
+	if c.csrf != "" && !form.Has("csrf_token") {
+		form.Set("csrf_token", c.csrf)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, testWebsite+path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(r)
+}
+
+// postMultipart sends the form as multipart, with files mapping field
+// names to file names and their content.
+func (c *testClient) postMultipart(path string, form url.Values, files map[string][2]string) *response {
+	c.t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if c.csrf != "" {
+		mw.WriteField("csrf_token", c.csrf)
+	}
+	for k, vs := range form {
+		for _, v := range vs {
+			mw.WriteField(k, v)
+		}
+	}
+	for field, file := range files {
+		fw, err := mw.CreateFormFile(field, file[0])
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		fw.Write([]byte(file[1]))
+	}
+	if err := mw.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, testWebsite+path, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(r)
+}
+
+// page gets a page and fails the test unless it rendered without error.
+func (c *testClient) page(path string) string {
+	c.t.Helper()
+
+	res := c.get(path)
+	res.ok(c.t, "GET "+path)
+	return res.Body
+}
+
+var errorText = regexp.MustCompile(`<p class="error-text">([^<]*)</p>`)
+
+// ok fails the test if the response is an error page. Error pages are
+// sent with a 200 status, so the page is checked too.
+func (r *response) ok(t *testing.T, what string) {
+	t.Helper()
+
+	if m := errorText.FindStringSubmatch(r.Body); m != nil {
+		t.Fatalf("%s: error page: %s", what, html.UnescapeString(m[1]))
+	}
+	if r.Code != http.StatusOK && r.Code != http.StatusFound {
+		t.Fatalf("%s: status %d", what, r.Code)
+	}
+}
+
+// redirect fails the test unless the response redirects to location.
+func (r *response) redirect(t *testing.T, what string, location string) {
+	t.Helper()
+
+	r.ok(t, what)
+	if r.Code != http.StatusFound {
+		t.Fatalf("%s: status %d, want a redirect to %s", what, r.Code, location)
+	}
+	if got := r.Header.Get("Location"); got != location {
+		t.Fatalf("%s: redirected to %q, want %q", what, got, location)
+	}
+}
+
+var csrfToken = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// signin goes through the OAuth flow with the fake instance, approving
+// the app as the user would.
+func (c *testClient) signin() {
+	c.t.Helper()
+
+	res := c.post("/signin", url.Values{"instance": {c.inst.host()}})
+	res.ok(c.t, "POST /signin")
+
+	loc, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || res.Code != http.StatusFound {
+		c.t.Fatalf("POST /signin: status %d, location %q", res.Code, res.Header.Get("Location"))
+	}
+	if want := c.inst.srv.URL + "/oauth/authorize"; loc.Scheme+"://"+loc.Host+loc.Path != want {
+		c.t.Fatalf("POST /signin: redirected to %s, want %s", loc, want)
+	}
+	if got := loc.Query().Get("redirect_uri"); got != testWebsite+"/oauth_callback" {
+		c.t.Fatalf("POST /signin: redirect_uri is %q", got)
+	}
+
+	code := c.inst.authorize(loc.Query().Get("client_id"))
+	res = c.get("/oauth_callback?code=" + url.QueryEscape(code))
+	res.redirect(c.t, "GET /oauth_callback", "/")
+
+	m := csrfToken.FindStringSubmatch(c.page("/settings"))
+	if m == nil {
+		c.t.Fatal("no CSRF token on the settings page")
+	}
+	c.csrf = m[1]
+}
+
+// Parts of pages that change from run to run are replaced before they
+// are compared with the golden files.
+var timeSince = regexp.MustCompile(`(<time [^>]*>)[^<]*(</time>)`)
+
+func (c *testClient) normalize(body string) string {
+	if c.csrf != "" {
+		body = strings.ReplaceAll(body, c.csrf, "CSRF_TOKEN")
+	}
+	// Saving the settings stamps them, and rules get a new ID.
+	if sess, err := c.getSession(); err == nil {
+		if sess.Settings.Stamp != "" {
+			body = strings.ReplaceAll(body, sess.Settings.Stamp, "STAMP")
+		}
+		for _, v := range sess.Settings.Rules {
+			body = strings.ReplaceAll(body, v.ID, "RULE_ID")
+		}
+	}
+	body = strings.ReplaceAll(body, c.inst.host(), "instance.test")
+	body = timeSince.ReplaceAllString(body, "${1}TIME${2}")
+	return body
+}
+
+// golden compares the page with testdata/golden/name.html, or rewrites
+// it with -update.
+func (c *testClient) golden(name string, body string) {
+	c.t.Helper()
+
+	body = c.normalize(body)
+	path := filepath.Join("testdata", "golden", name+".html")
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			c.t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+			c.t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		c.t.Fatalf("%v, run the tests with -update to create it", err)
+	}
+
+	if body != string(want) {
+		c.t.Errorf("%s differs from %s, run the tests with -update if the change is intended\n%s",
+			name, path, diffLines(string(want), body))
+	}
+}
+
+// diffLines shows the first lines where got differs from want, which is
+// enough to find what changed in a template.
+func diffLines(want, got string) string {
+	wl := strings.Split(want, "\n")
+	gl := strings.Split(got, "\n")
+
+	var b strings.Builder
+	shown := 0
+	for i := 0; i < max(len(wl), len(gl)) && shown < 10; i++ {
+		var w, g string
+		if i < len(wl) {
+			w = wl[i]
+		}
+		if i < len(gl) {
+			g = gl[i]
+		}
+		if w != g {
+			b.WriteString("line " + strconv.Itoa(i+1) + ":\n-" + w + "\n+" + g + "\n")
+			shown++
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,933 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEpoch is when the fixtures were posted. Pages show how long ago
+// that was, which the golden files leave out.
+var fakeEpoch = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// The types below are the parts of the API entities 8bloat reads, in the
+// shape instances send them.
+
+type apiEmoji struct {
+	Shortcode string `json:"shortcode"`
+	URL       string `json:"url"`
+	StaticURL string `json:"static_url"`
+}
+
+type apiAccount struct {
+	ID             string     `json:"id"`
+	Username       string     `json:"username"`
+	Acct           string     `json:"acct"`
+	DisplayName    string     `json:"display_name"`
+	Locked         bool       `json:"locked"`
+	Bot            bool       `json:"bot"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Note           string     `json:"note"`
+	URL            string     `json:"url"`
+	Avatar         string     `json:"avatar"`
+	AvatarStatic   string     `json:"avatar_static"`
+	Header         string     `json:"header"`
+	HeaderStatic   string     `json:"header_static"`
+	FollowersCount int64      `json:"followers_count"`
+	FollowingCount int64      `json:"following_count"`
+	StatusesCount  int64      `json:"statuses_count"`
+	Emojis         []apiEmoji `json:"emojis"`
+	Fields         []any      `json:"fields"`
+	Source         *apiSource `json:"source,omitempty"`
+}
+
+type apiSource struct {
+	Privacy   string `json:"privacy"`
+	Sensitive bool   `json:"sensitive"`
+	Note      string `json:"note"`
+	Fields    []any  `json:"fields"`
+}
+
+type apiAttachment struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	URL         string `json:"url"`
+	PreviewURL  string `json:"preview_url"`
+	Description string `json:"description"`
+}
+
+type apiReaction struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+	Me    bool   `json:"me"`
+}
+
+type apiStatus struct {
+	ID                 string            `json:"id"`
+	URI                string            `json:"uri"`
+	URL                string            `json:"url"`
+	CreatedAt          time.Time         `json:"created_at"`
+	Account            *apiAccount       `json:"account"`
+	InReplyToID        *string           `json:"in_reply_to_id"`
+	InReplyToAccountID *string           `json:"in_reply_to_account_id"`
+	Reblog             *apiStatus        `json:"reblog"`
+	Content            string            `json:"content"`
+	Visibility         string            `json:"visibility"`
+	Sensitive          bool              `json:"sensitive"`
+	SpoilerText        string            `json:"spoiler_text"`
+	MediaAttachments   []apiAttachment   `json:"media_attachments"`
+	Mentions           []any             `json:"mentions"`
+	Tags               []any             `json:"tags"`
+	Emojis             []apiEmoji        `json:"emojis"`
+	RepliesCount       int64             `json:"replies_count"`
+	ReblogsCount       int64             `json:"reblogs_count"`
+	FavouritesCount    int64             `json:"favourites_count"`
+	Favourited         bool              `json:"favourited"`
+	Reblogged          bool              `json:"reblogged"`
+	Bookmarked         bool              `json:"bookmarked"`
+	Muted              bool              `json:"muted"`
+	Pinned             bool              `json:"pinned"`
+	Filtered           []apiFilterResult `json:"filtered,omitempty"`
+	Pleroma            struct {
+		EmojiReactions []apiReaction `json:"emoji_reactions"`
+	} `json:"pleroma"`
+}
+
+type apiNotification struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Account   *apiAccount `json:"account"`
+	Status    *apiStatus  `json:"status,omitempty"`
+	Emoji     string      `json:"emoji,omitempty"`
+	Pleroma   struct {
+		IsSeen bool `json:"is_seen"`
+	} `json:"pleroma"`
+}
+
+type apiRelationship struct {
+	ID         string `json:"id"`
+	Following  bool   `json:"following"`
+	FollowedBy bool   `json:"followed_by"`
+	Blocking   bool   `json:"blocking"`
+	Muting     bool   `json:"muting"`
+	Requested  bool   `json:"requested"`
+}
+
+type apiList struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+type apiFilter struct {
+	ID           string   `json:"id"`
+	Phrase       string   `json:"phrase"`
+	Context      []string `json:"context"`
+	WholeWord    bool     `json:"whole_word"`
+	Irreversible bool     `json:"irreversible"`
+}
+
+// apiFilterV2 is a filter of Mastodon 4.0, which the instance only has
+// when it's taken for one.
+type apiFilterV2 struct {
+	ID           string             `json:"id"`
+	Title        string             `json:"title"`
+	Context      []string           `json:"context"`
+	ExpiresAt    *time.Time         `json:"expires_at"`
+	FilterAction string             `json:"filter_action"`
+	Keywords     []apiFilterKeyword `json:"keywords"`
+}
+
+type apiFilterKeyword struct {
+	ID        string `json:"id"`
+	Keyword   string `json:"keyword"`
+	WholeWord bool   `json:"whole_word"`
+}
+
+type apiFilterResult struct {
+	Filter         *apiFilterV2 `json:"filter"`
+	KeywordMatches []string     `json:"keyword_matches"`
+}
+
+// fakeInstance is a stand-in Pleroma instance, or some other software if
+// it's changed before signing in. It keeps its accounts, statuses and the
+// rest in memory, and changes them as 8bloat asks, so that tests can
+// check both what was sent and what is shown afterwards. Calls to
+// endpoints it doesn't serve fail the test.
+type fakeInstance struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	software string
+	version  string
+
+	// withheld statuses are left out of pages after they're cut, the
+	// way instances filter some out on their side.
+	withheld map[string]bool
+
+	// nodeInfoHref is where the well-known document says nodeinfo is,
+	// if not on the instance.
+	nodeInfoHref string
+
+	// clientGrants counts the tokens asked for by apps rather than
+	// users, which fail if clientGrantsDown is set.
+	clientGrants     int
+	clientGrantsDown bool
+
+	mu            sync.Mutex
+	lastID        int
+	apps          map[string]string
+	codes         map[string]string
+	tokens        map[string]bool
+	me            *apiAccount
+	accounts      map[string]*apiAccount
+	statuses      []*apiStatus
+	notifications []*apiNotification
+	lists         []*apiList
+	listAccounts  map[string][]string
+	filters       []*apiFilter
+	filtersV2     []*apiFilterV2
+	media         map[string]*apiAttachment
+	following     map[string]bool
+}
+
+func newFakeInstance(t *testing.T) *fakeInstance {
+	f := &fakeInstance{
+		t:            t,
+		software:     "pleroma",
+		version:      "2.6.0",
+		lastID:       100,
+		apps:         make(map[string]string),
+		codes:        make(map[string]string),
+		tokens:       make(map[string]bool),
+		accounts:     make(map[string]*apiAccount),
+		listAccounts: make(map[string][]string),
+		media:        make(map[string]*apiAttachment),
+		following:    make(map[string]bool),
+		withheld:     make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	f.routes(mux)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("fake instance: unexpected request %s %s", r.Method, r.URL.Path)
+		http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+	})
+
+	f.srv = httptest.NewTLSServer(mux)
+	t.Cleanup(f.srv.Close)
+
+	f.seed()
+	return f
+}
+
+// host is what's entered to sign in to the instance.
+func (f *fakeInstance) host() string {
+	return strings.TrimPrefix(f.srv.URL, "https://")
+}
+
+func (f *fakeInstance) id() string {
+	f.lastID++
+	return strconv.Itoa(f.lastID)
+}
+
+func (f *fakeInstance) account(id, username, name string) *apiAccount {
+	a := &apiAccount{
+		ID:             id,
+		Username:       username,
+		Acct:           username,
+		DisplayName:    name,
+		CreatedAt:      fakeEpoch.AddDate(-1, 0, 0),
+		Note:           "<p>Hi, I'm " + name + ".</p>",
+		URL:            f.srv.URL + "/users/" + username,
+		Avatar:         f.srv.URL + "/avatars/" + username + ".png",
+		AvatarStatic:   f.srv.URL + "/avatars/" + username + ".png",
+		Header:         f.srv.URL + "/headers/" + username + ".png",
+		HeaderStatic:   f.srv.URL + "/headers/" + username + ".png",
+		FollowersCount: 2,
+		FollowingCount: 1,
+		StatusesCount:  1,
+		Emojis:         []apiEmoji{},
+		Fields:         []any{},
+	}
+	f.accounts[id] = a
+	return a
+}
+
+func (f *fakeInstance) status(id string, acct *apiAccount, content string, at time.Time) *apiStatus {
+	return &apiStatus{
+		ID:               id,
+		URI:              f.srv.URL + "/objects/" + id,
+		URL:              f.srv.URL + "/notice/" + id,
+		CreatedAt:        at,
+		Account:          acct,
+		Content:          content,
+		Visibility:       "public",
+		MediaAttachments: []apiAttachment{},
+		Mentions:         []any{},
+		Tags:             []any{},
+		Emojis:           []apiEmoji{},
+	}
+}
+
+// seed fills the instance with what the tests expect to find: the signed
+// in user, two others, a short thread and notifications for it.
+func (f *fakeInstance) seed() {
+	f.me = f.account("1", "alice", "Alice")
+	f.me.Source = &apiSource{Privacy: "public", Note: "Hi, I'm Alice.", Fields: []any{}}
+	bob := f.account("2", "bob", "Bob")
+	carol := f.account("3", "carol", "Carol")
+
+	first := f.status("10", f.me, "<p>Hello from Alice.</p>", fakeEpoch)
+	reply := f.status("11", bob, "<p>Hi Alice, Bob here.</p>", fakeEpoch.Add(time.Hour))
+	reply.InReplyToID = &first.ID
+	reply.InReplyToAccountID = &f.me.ID
+	reply.Mentions = []any{map[string]string{"id": "1", "username": "alice", "acct": "alice", "url": f.me.URL}}
+	other := f.status("12", carol, "<p>Carol's own post.</p>", fakeEpoch.Add(2*time.Hour))
+	f.statuses = []*apiStatus{other, reply, first}
+
+	f.notifications = []*apiNotification{
+		f.notification("23", "mention", carol, reply, fakeEpoch.Add(3*time.Hour)),
+		f.notification("22", "favourite", carol, first, fakeEpoch.Add(2*time.Hour)),
+		f.notification("21", "favourite", bob, first, fakeEpoch.Add(time.Hour)),
+		f.notification("20", "follow", bob, nil, fakeEpoch),
+	}
+
+	f.lists = []*apiList{{ID: "30", Title: "Friends"}}
+	f.listAccounts["30"] = []string{"2"}
+
+	f.filters = []*apiFilter{{ID: "40", Phrase: "spoilers", Context: []string{"home", "public"}}}
+}
+
+func (f *fakeInstance) notification(id, typ string, acct *apiAccount, st *apiStatus, at time.Time) *apiNotification {
+	return &apiNotification{ID: id, Type: typ, CreatedAt: at, Account: acct, Status: st}
+}
+
+// authorize stands in for the user approving the app on the instance,
+// and returns the code the instance would send them back with.
+func (f *fakeInstance) authorize(clientID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	code := "code-" + f.id()
+	f.codes[code] = clientID
+	return code
+}
+
+func (f *fakeInstance) findStatus(id string) *apiStatus {
+	for _, v := range f.statuses {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (f *fakeInstance) routes(mux *http.ServeMux) {
+	open := func(pattern string, h func(r *http.Request) (any, int)) {
+		mux.HandleFunc(pattern, f.serve(h, false))
+	}
+	authed := func(pattern string, h func(r *http.Request) (any, int)) {
+		mux.HandleFunc(pattern, f.serve(h, true))
+	}
+
+	open("GET /api/v1/instance", f.instance)
+	open("GET /.well-known/nodeinfo", f.nodeInfoLinks)
+	open("GET /nodeinfo/2.1", f.nodeInfo)
+	open("POST /api/v1/apps", f.registerApp)
+	open("POST /oauth/token", f.token)
+	open("POST /oauth/revoke", f.revoke)
+
+	authed("GET /api/v1/accounts/verify_credentials", f.verifyCredentials)
+	authed("PATCH /api/v1/accounts/update_credentials", f.updateCredentials)
+	authed("GET /api/v1/accounts/relationships", f.relationships)
+	authed("GET /api/v1/accounts/{id}", f.getAccount)
+	authed("GET /api/v1/accounts/{id}/statuses", f.accountStatuses)
+	authed("GET /api/v1/accounts/{id}/following", f.accountFollowing)
+	authed("GET /api/v1/custom_emojis", f.emojis)
+
+	authed("GET /api/v1/timelines/home", f.timeline)
+	authed("GET /api/v1/timelines/public", f.timeline)
+	authed("GET /api/v1/timelines/list/{id}", f.listTimeline)
+
+	authed("POST /api/v1/statuses", f.postStatus)
+	authed("GET /api/v1/statuses/{id}", f.getStatus)
+	authed("GET /api/v1/statuses/{id}/context", f.statusContext)
+	authed("POST /api/v1/statuses/{id}/{action}", f.statusAction)
+
+	authed("GET /api/v1/notifications", f.getNotifications)
+	authed("POST /api/v1/pleroma/notifications/read", f.readNotifications)
+
+	authed("GET /api/v1/lists", f.getLists)
+	authed("POST /api/v1/lists", f.createList)
+	authed("GET /api/v1/lists/{id}", f.getList)
+	authed("GET /api/v1/lists/{id}/accounts", f.getListAccounts)
+
+	authed("GET /api/v1/filters", f.getFilters)
+	authed("POST /api/v1/filters", f.createFilter)
+	authed("DELETE /api/v1/filters/{id}", f.deleteFilter)
+	authed("GET /api/v2/filters", f.getFiltersV2)
+	authed("POST /api/v2/filters", f.createFilterV2)
+	authed("DELETE /api/v2/filters/{id}", f.deleteFilterV2)
+
+	authed("POST /api/v2/media", f.uploadMedia)
+	authed("PUT /api/v1/media/{id}", f.updateMedia)
+}
+
+// serve wraps the handlers, which return what to respond with. Errors
+// are returned as a string, and sent the way instances do.
+func (f *fakeInstance) serve(h func(r *http.Request) (any, int), auth bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if auth {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !f.tokens[token] {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "The access token is invalid"})
+				return
+			}
+		}
+
+		res, code := h(r)
+		if p, ok := res.(paged); ok {
+			if p.link != "" {
+				w.Header().Set("Link", p.link)
+			}
+			res = p.items
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if msg, ok := res.(string); ok {
+			res = map[string]string{"error": msg}
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			f.t.Errorf("fake instance: encoding response: %v", err)
+		}
+	}
+}
+
+func (f *fakeInstance) instance(r *http.Request) (any, int) {
+	return map[string]any{
+		"uri":            f.srv.URL,
+		"title":          "Fake",
+		"version":        "2.7.2 (compatible; Pleroma 2.6.0)",
+		"max_toot_chars": 5000,
+		"pleroma": map[string]any{
+			"metadata": map[string]any{
+				"features":     []string{"pleroma_emoji_reactions"},
+				"post_formats": []string{"text/plain", "text/markdown"},
+			},
+		},
+	}, http.StatusOK
+}
+
+func (f *fakeInstance) nodeInfoLinks(r *http.Request) (any, int) {
+	href := f.srv.URL + "/nodeinfo/2.1"
+	if f.nodeInfoHref != "" {
+		href = f.nodeInfoHref
+	}
+	return map[string]any{
+		"links": []map[string]string{{
+			"rel":  "http://nodeinfo.diaspora.software/ns/schema/2.1",
+			"href": href,
+		}},
+	}, http.StatusOK
+}
+
+func (f *fakeInstance) nodeInfo(r *http.Request) (any, int) {
+	return map[string]any{
+		"software": map[string]string{"name": f.software, "version": f.version},
+	}, http.StatusOK
+}
+
+func (f *fakeInstance) registerApp(r *http.Request) (any, int) {
+	if r.FormValue("redirect_uris") == "" || r.FormValue("client_name") == "" {
+		return "missing parameters", http.StatusUnprocessableEntity
+	}
+
+	id := "client-" + f.id()
+	f.apps[id] = "secret-" + id
+	return map[string]string{
+		"id":            id,
+		"client_id":     id,
+		"client_secret": f.apps[id],
+		"redirect_uri":  r.FormValue("redirect_uris"),
+	}, http.StatusOK
+}
+
+func (f *fakeInstance) token(r *http.Request) (any, int) {
+	id := r.FormValue("client_id")
+	if secret, ok := f.apps[id]; !ok || secret != r.FormValue("client_secret") {
+		return "invalid_client", http.StatusUnauthorized
+	}
+
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		code := r.FormValue("code")
+		if f.codes[code] != id {
+			return "invalid_grant", http.StatusBadRequest
+		}
+		delete(f.codes, code)
+	case "client_credentials":
+		f.clientGrants++
+		if f.clientGrantsDown {
+			return "Service unavailable", http.StatusServiceUnavailable
+		}
+	default:
+		return "unsupported_grant_type", http.StatusBadRequest
+	}
+
+	token := "token-" + f.id()
+	f.tokens[token] = true
+	return map[string]string{"access_token": token, "token_type": "Bearer"}, http.StatusOK
+}
+
+func (f *fakeInstance) revoke(r *http.Request) (any, int) {
+	delete(f.tokens, r.FormValue("token"))
+	return map[string]any{}, http.StatusOK
+}
+
+func (f *fakeInstance) verifyCredentials(r *http.Request) (any, int) {
+	return f.me, http.StatusOK
+}
+
+func (f *fakeInstance) updateCredentials(r *http.Request) (any, int) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		return err.Error(), http.StatusBadRequest
+	}
+	if v, ok := r.Form["display_name"]; ok {
+		f.me.DisplayName = v[0]
+	}
+	if v, ok := r.Form["note"]; ok {
+		f.me.Note = "<p>" + v[0] + "</p>"
+	}
+	return f.me, http.StatusOK
+}
+
+func (f *fakeInstance) relationships(r *http.Request) (any, int) {
+	rels := []apiRelationship{}
+	for _, id := range r.URL.Query()["id[]"] {
+		rels = append(rels, apiRelationship{ID: id, Following: f.following[id]})
+	}
+	return rels, http.StatusOK
+}
+
+func (f *fakeInstance) getAccount(r *http.Request) (any, int) {
+	a, ok := f.accounts[r.PathValue("id")]
+	if !ok {
+		return "Record not found", http.StatusNotFound
+	}
+	return a, http.StatusOK
+}
+
+func (f *fakeInstance) accountFollowing(r *http.Request) (any, int) {
+	accounts := []*apiAccount{}
+	if r.PathValue("id") == f.me.ID {
+		for id := range f.following {
+			if f.following[id] {
+				accounts = append(accounts, f.accounts[id])
+			}
+		}
+	}
+	slices.SortFunc(accounts, func(a, b *apiAccount) int { return strings.Compare(a.ID, b.ID) })
+	return accounts, http.StatusOK
+}
+
+func (f *fakeInstance) accountStatuses(r *http.Request) (any, int) {
+	statuses := []*apiStatus{}
+	for _, v := range f.statuses {
+		if v.Account.ID == r.PathValue("id") {
+			statuses = append(statuses, v)
+		}
+	}
+	return f.page(r, statuses), http.StatusOK
+}
+
+func (f *fakeInstance) emojis(r *http.Request) (any, int) {
+	return []apiEmoji{}, http.StatusOK
+}
+
+func (f *fakeInstance) timeline(r *http.Request) (any, int) {
+	return f.page(r, f.statuses), http.StatusOK
+}
+
+func (f *fakeInstance) listTimeline(r *http.Request) (any, int) {
+	members := f.listAccounts[r.PathValue("id")]
+	statuses := []*apiStatus{}
+	for _, v := range f.statuses {
+		if slices.Contains(members, v.Account.ID) {
+			statuses = append(statuses, v)
+		}
+	}
+	return f.page(r, statuses), http.StatusOK
+}
+
+func (f *fakeInstance) postStatus(r *http.Request) (any, int) {
+	if err := r.ParseForm(); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+
+	content := r.PostForm.Get("status")
+	if content == "" {
+		return "Validation failed: Text can't be blank", http.StatusUnprocessableEntity
+	}
+
+	// The newest status is a minute after the newest fixture, so that
+	// the order is the same every run.
+	s := f.status(f.id(), f.me, "<p>"+content+"</p>", f.statuses[0].CreatedAt.Add(time.Minute))
+	if v := r.PostForm.Get("visibility"); v != "" {
+		s.Visibility = v
+	}
+	s.SpoilerText = r.PostForm.Get("spoiler_text")
+	s.Sensitive = r.PostForm.Get("sensitive") == "true"
+	if v := r.PostForm.Get("in_reply_to_id"); v != "" {
+		s.InReplyToID = &v
+	}
+	for _, id := range r.PostForm["media_ids[]"] {
+		m, ok := f.media[id]
+		if !ok {
+			return "Media not found", http.StatusUnprocessableEntity
+		}
+		s.MediaAttachments = append(s.MediaAttachments, *m)
+	}
+
+	f.statuses = append([]*apiStatus{s}, f.statuses...)
+	f.me.StatusesCount++
+	return s, http.StatusOK
+}
+
+func (f *fakeInstance) getStatus(r *http.Request) (any, int) {
+	s := f.findStatus(r.PathValue("id"))
+	if s == nil {
+		return "Record not found", http.StatusNotFound
+	}
+	return s, http.StatusOK
+}
+
+func (f *fakeInstance) statusContext(r *http.Request) (any, int) {
+	s := f.findStatus(r.PathValue("id"))
+	if s == nil {
+		return "Record not found", http.StatusNotFound
+	}
+
+	ancestors := []*apiStatus{}
+	for p := s; p.InReplyToID != nil; {
+		if p = f.findStatus(*p.InReplyToID); p == nil {
+			break
+		}
+		ancestors = append([]*apiStatus{p}, ancestors...)
+	}
+
+	descendants := []*apiStatus{}
+	for i := len(f.statuses) - 1; i >= 0; i-- {
+		v := f.statuses[i]
+		if v.InReplyToID != nil && *v.InReplyToID == s.ID {
+			descendants = append(descendants, v)
+		}
+	}
+
+	return map[string]any{"ancestors": ancestors, "descendants": descendants}, http.StatusOK
+}
+
+func (f *fakeInstance) statusAction(r *http.Request) (any, int) {
+	s := f.findStatus(r.PathValue("id"))
+	if s == nil {
+		return "Record not found", http.StatusNotFound
+	}
+
+	switch r.PathValue("action") {
+	case "favourite":
+		if !s.Favourited {
+			s.Favourited = true
+			s.FavouritesCount++
+		}
+	case "unfavourite":
+		if s.Favourited {
+			s.Favourited = false
+			s.FavouritesCount--
+		}
+	case "reblog":
+		s.Reblogged = true
+		s.ReblogsCount++
+	case "unreblog":
+		s.Reblogged = false
+		s.ReblogsCount--
+	case "bookmark":
+		s.Bookmarked = true
+	case "unbookmark":
+		s.Bookmarked = false
+	default:
+		f.t.Errorf("fake instance: unexpected status action %s", r.PathValue("action"))
+		return "Not found", http.StatusNotFound
+	}
+
+	return s, http.StatusOK
+}
+
+func (f *fakeInstance) getNotifications(r *http.Request) (any, int) {
+	q := r.URL.Query()
+	include := q["include_types[]"]
+	exclude := q["exclude_types[]"]
+
+	notifs := []*apiNotification{}
+	for _, v := range f.notifications {
+		if len(include) > 0 && !slices.Contains(include, v.Type) || slices.Contains(exclude, v.Type) {
+			continue
+		}
+		notifs = append(notifs, v)
+	}
+	return notifs, http.StatusOK
+}
+
+func (f *fakeInstance) readNotifications(r *http.Request) (any, int) {
+	maxID := r.FormValue("max_id")
+	for _, v := range f.notifications {
+		if idLess(v.ID, maxID) || v.ID == maxID {
+			v.Pleroma.IsSeen = true
+		}
+	}
+	return f.notifications, http.StatusOK
+}
+
+func (f *fakeInstance) getLists(r *http.Request) (any, int) {
+	return f.lists, http.StatusOK
+}
+
+func (f *fakeInstance) createList(r *http.Request) (any, int) {
+	l := &apiList{ID: f.id(), Title: r.FormValue("title")}
+	f.lists = append(f.lists, l)
+	return l, http.StatusOK
+}
+
+func (f *fakeInstance) getList(r *http.Request) (any, int) {
+	for _, v := range f.lists {
+		if v.ID == r.PathValue("id") {
+			return v, http.StatusOK
+		}
+	}
+	return "Record not found", http.StatusNotFound
+}
+
+// getListAccounts pages through the accounts in the order they were
+// added, max_id being the last one of the page before.
+func (f *fakeInstance) getListAccounts(r *http.Request) (any, int) {
+	q := r.URL.Query()
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 40
+	}
+
+	ids := f.listAccounts[r.PathValue("id")]
+	if i := slices.Index(ids, q.Get("max_id")); i >= 0 {
+		ids = ids[i+1:]
+	}
+
+	accounts := []*apiAccount{}
+	for _, id := range ids[:min(limit, len(ids))] {
+		accounts = append(accounts, f.accounts[id])
+	}
+
+	var link string
+	if len(ids) > limit {
+		link = "<https://" + r.Host + r.URL.Path + "?max_id=" + ids[limit-1] + `>; rel="next"`
+	}
+	return paged{items: accounts, link: link}, http.StatusOK
+}
+
+func (f *fakeInstance) getFilters(r *http.Request) (any, int) {
+	return f.filters, http.StatusOK
+}
+
+func (f *fakeInstance) createFilter(r *http.Request) (any, int) {
+	if err := r.ParseForm(); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+
+	filter := &apiFilter{
+		ID:           f.id(),
+		Phrase:       r.PostForm.Get("phrase"),
+		Context:      r.PostForm["context[]"],
+		WholeWord:    r.PostForm.Get("whole_word") == "true",
+		Irreversible: r.PostForm.Get("irreversible") == "true",
+	}
+	if filter.Phrase == "" || len(filter.Context) == 0 {
+		return "Validation failed", http.StatusUnprocessableEntity
+	}
+
+	f.filters = append(f.filters, filter)
+	return filter, http.StatusOK
+}
+
+func (f *fakeInstance) deleteFilter(r *http.Request) (any, int) {
+	f.filters = slices.DeleteFunc(f.filters, func(v *apiFilter) bool {
+		return v.ID == r.PathValue("id")
+	})
+	return map[string]any{}, http.StatusOK
+}
+
+func (f *fakeInstance) getFiltersV2(r *http.Request) (any, int) {
+	return append([]*apiFilterV2{}, f.filtersV2...), http.StatusOK
+}
+
+// createFilterV2 creates the filter and marks the statuses it matches,
+// which is all the instance does with it.
+func (f *fakeInstance) createFilterV2(r *http.Request) (any, int) {
+	if err := r.ParseForm(); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+
+	filter := &apiFilterV2{
+		ID:           f.id(),
+		Title:        r.PostForm.Get("title"),
+		Context:      r.PostForm["context[]"],
+		FilterAction: r.PostForm.Get("filter_action"),
+	}
+	for i := 0; ; i++ {
+		key := "keywords_attributes[" + strconv.Itoa(i) + "]"
+		if !r.PostForm.Has(key + "[keyword]") {
+			break
+		}
+		filter.Keywords = append(filter.Keywords, apiFilterKeyword{
+			ID:        f.id(),
+			Keyword:   r.PostForm.Get(key + "[keyword]"),
+			WholeWord: r.PostForm.Get(key+"[whole_word]") == "true",
+		})
+	}
+	if filter.Title == "" || len(filter.Context) == 0 || len(filter.Keywords) == 0 {
+		return "Validation failed", http.StatusUnprocessableEntity
+	}
+	if v := r.PostForm.Get("expires_in"); v != "" {
+		secs, _ := strconv.Atoi(v)
+		at := time.Now().Add(time.Duration(secs) * time.Second)
+		filter.ExpiresAt = &at
+	}
+
+	for _, st := range f.statuses {
+		for _, k := range filter.Keywords {
+			if strings.Contains(strings.ToLower(st.Content), strings.ToLower(k.Keyword)) {
+				st.Filtered = append(st.Filtered, apiFilterResult{Filter: filter, KeywordMatches: []string{k.Keyword}})
+				break
+			}
+		}
+	}
+
+	f.filtersV2 = append(f.filtersV2, filter)
+	return filter, http.StatusOK
+}
+
+func (f *fakeInstance) deleteFilterV2(r *http.Request) (any, int) {
+	id := r.PathValue("id")
+	f.filtersV2 = slices.DeleteFunc(f.filtersV2, func(v *apiFilterV2) bool {
+		return v.ID == id
+	})
+	for _, st := range f.statuses {
+		st.Filtered = slices.DeleteFunc(st.Filtered, func(v apiFilterResult) bool {
+			return v.Filter.ID == id
+		})
+	}
+	return map[string]any{}, http.StatusOK
+}
+
+func (f *fakeInstance) uploadMedia(r *http.Request) (any, int) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return "Validation failed: File can't be blank", http.StatusUnprocessableEntity
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(io.Discard, file); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+
+	id := f.id()
+	m := &apiAttachment{
+		ID:          id,
+		Type:        "image",
+		URL:         f.srv.URL + "/media/" + url.PathEscape(header.Filename),
+		PreviewURL:  f.srv.URL + "/media/" + url.PathEscape(header.Filename),
+		Description: r.FormValue("description"),
+	}
+	f.media[id] = m
+	return m, http.StatusOK
+}
+
+func (f *fakeInstance) updateMedia(r *http.Request) (any, int) {
+	m, ok := f.media[r.PathValue("id")]
+	if !ok {
+		return "Record not found", http.StatusNotFound
+	}
+	if err := r.ParseForm(); err != nil {
+		return err.Error(), http.StatusBadRequest
+	}
+	if v, ok := r.PostForm["description"]; ok {
+		m.Description = v[0]
+	}
+	return m, http.StatusOK
+}
+
+// paged is a page of a list, sent with a Link header to the pages around
+// it.
+type paged struct {
+	items any
+	link  string
+}
+
+// page returns up to limit statuses between max_id and min_id, newest
+// first, less those withheld. Like Mastodon, the Link header has the next
+// page only if this one is full, before withholding.
+func (f *fakeInstance) page(r *http.Request, statuses []*apiStatus) paged {
+	q := r.URL.Query()
+	maxID, minID := q.Get("max_id"), q.Get("min_id")
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+
+	res := []*apiStatus{}
+	for _, v := range statuses {
+		if maxID != "" && !idLess(v.ID, maxID) || minID != "" && !idLess(minID, v.ID) {
+			continue
+		}
+		res = append(res, v)
+	}
+
+	// min_id pages are the statuses right after it.
+	full := len(res) >= limit
+	if full && minID != "" {
+		res = res[len(res)-limit:]
+	} else if full {
+		res = res[:limit]
+	}
+
+	if len(res) == 0 {
+		return paged{items: res}
+	}
+
+	base := "https://" + r.Host + r.URL.Path
+	link := "<" + base + "?min_id=" + res[0].ID + `>; rel="prev"`
+	if full {
+		link = "<" + base + "?max_id=" + res[len(res)-1].ID + `>; rel="next", ` + link
+	}
+	res = slices.DeleteFunc(res, func(v *apiStatus) bool { return f.withheld[v.ID] })
+	return paged{items: res, link: link}
+}
+
+// idLess compares IDs the way instances order them, by length and then
+// lexically.
+func idLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -0,0 +1,246 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms, in
+// seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+
+	s := d.Seconds()
+	for i, v := range latencyBuckets {
+		if s <= v {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	for i, v := range latencyBuckets {
+		var n uint64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64), n)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+type routeMetrics struct {
+	statuses         map[int]uint64
+	errors           uint64
+	latency          histogram
+	upstreamRequests uint64
+	upstreamErrors   uint64
+	upstreamLatency  histogram
+}
+
+// metrics counts requests per route, and what they asked of the upstream
+// instance. Routes are the registered patterns rather than paths, so that
+// the number of series stays bounded.
+type metrics struct {
+	mu     sync.Mutex
+	routes map[routeKey]*routeMetrics
+}
+
+func newMetrics() *metrics {
+	return &metrics{routes: make(map[routeKey]*routeMetrics)}
+}
+
+func (m *metrics) observe(method string, route string, status int, failed bool, took time.Duration, up *upstreamStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := routeKey{method, route}
+	r, ok := m.routes[k]
+	if !ok {
+		r = &routeMetrics{statuses: make(map[int]uint64)}
+		m.routes[k] = r
+	}
+
+	r.statuses[status]++
+	if failed {
+		r.errors++
+	}
+	r.latency.observe(took)
+
+	requests, errors, latencies := up.snapshot()
+	r.upstreamRequests += uint64(requests)
+	r.upstreamErrors += uint64(errors)
+	for _, v := range latencies {
+		r.upstreamLatency.observe(v)
+	}
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]routeKey, 0, len(m.routes))
+	for k := range m.routes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].method < keys[j].method
+	})
+
+	labels := func(k routeKey) string {
+		return "method=" + strconv.Quote(k.method) + ",route=" + strconv.Quote(k.route)
+	}
+
+	fmt.Fprintln(w, "# HELP bloat_http_requests_total Requests handled, by route and status code.")
+	fmt.Fprintln(w, "# TYPE bloat_http_requests_total counter")
+	for _, k := range keys {
+		r := m.routes[k]
+		statuses := make([]int, 0, len(r.statuses))
+		for s := range r.statuses {
+			statuses = append(statuses, s)
+		}
+		sort.Ints(statuses)
+		for _, s := range statuses {
+			fmt.Fprintf(w, "bloat_http_requests_total{%s,status=\"%d\"} %d\n", labels(k), s, r.statuses[s])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP bloat_http_request_errors_total Requests that ended with an error page.")
+	fmt.Fprintln(w, "# TYPE bloat_http_request_errors_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "bloat_http_request_errors_total{%s} %d\n", labels(k), m.routes[k].errors)
+	}
+
+	fmt.Fprintln(w, "# HELP bloat_http_request_duration_seconds Time taken to handle requests.")
+	fmt.Fprintln(w, "# TYPE bloat_http_request_duration_seconds histogram")
+	for _, k := range keys {
+		m.routes[k].latency.write(w, "bloat_http_request_duration_seconds", labels(k))
+	}
+
+	fmt.Fprintln(w, "# HELP bloat_upstream_requests_total Requests made to upstream instances.")
+	fmt.Fprintln(w, "# TYPE bloat_upstream_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "bloat_upstream_requests_total{%s} %d\n", labels(k), m.routes[k].upstreamRequests)
+	}
+
+	fmt.Fprintln(w, "# HELP bloat_upstream_errors_total Upstream requests that failed or got an error status.")
+	fmt.Fprintln(w, "# TYPE bloat_upstream_errors_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "bloat_upstream_errors_total{%s} %d\n", labels(k), m.routes[k].upstreamErrors)
+	}
+
+	fmt.Fprintln(w, "# HELP bloat_upstream_request_duration_seconds Time taken by upstream requests.")
+	fmt.Fprintln(w, "# TYPE bloat_upstream_request_duration_seconds histogram")
+	for _, k := range keys {
+		m.routes[k].upstreamLatency.write(w, "bloat_upstream_request_duration_seconds", labels(k))
+	}
+}
+
+// upstreamStats records the upstream requests made while handling a
+// request. Requests may be made concurrently.
+type upstreamStats struct {
+	mu        sync.Mutex
+	requests  int
+	errors    int
+	latencies []time.Duration
+}
+
+// Transport wraps rt, so that the requests that go through it are
+// recorded.
+func (s *upstreamStats) Transport(rt http.RoundTripper) http.RoundTripper {
+	return &statsTripper{underlying: rt, stats: s}
+}
+
+// snapshot returns the number of requests, how many failed, and how long
+// each took.
+func (s *upstreamStats) snapshot() (requests int, errors int, latencies []time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.errors, append([]time.Duration(nil), s.latencies...)
+}
+
+// total returns how long was spent waiting on upstream requests.
+func (s *upstreamStats) total() (d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.latencies {
+		d += v
+	}
+	return
+}
+
+type statsTripper struct {
+	underlying http.RoundTripper
+	stats      *upstreamStats
+}
+
+func (t *statsTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	begin := time.Now()
+	resp, err := t.underlying.RoundTrip(r)
+	took := time.Since(begin)
+
+	t.stats.mu.Lock()
+	t.stats.requests++
+	if err != nil || resp.StatusCode >= 400 {
+		t.stats.errors++
+	}
+	t.stats.latencies = append(t.stats.latencies, took)
+	t.stats.mu.Unlock()
+
+	return resp, err
+}
+
+// statusWriter remembers the status code of the response, for logging.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"maps"
+	"net/url"
+	"spiderden.org/8bloat/internal/conf"
+	"strconv"
+
+	"spiderden.org/8bloat/internal/render"
+
+	"spiderden.org/masta"
+)
+
+// pager pages through a list from the max_id and min_id of the request.
+// pg is passed to the instance, which replaces it with the range in the
+// Link header of its response. The links to the pages around keep the
+// other parameters of the request.
+type pager struct {
+	path  string
+	query url.Values
+	maxID string
+	minID string
+	limit int
+	pg    masta.Pagination
+}
+
+func newPager(t *Transaction) *pager {
+	q := t.R.URL.Query()
+	p := &pager{
+		path:  t.R.URL.EscapedPath(),
+		query: q,
+		maxID: q.Get("max_id"),
+		minID: q.Get("min_id"),
+		limit: t.pageSize(),
+	}
+	p.pg = masta.Pagination{
+		MaxID: p.maxID,
+		MinID: p.minID,
+		Limit: int64(p.limit),
+	}
+	return p
+}
+
+// pageSize is how many entries the user wants on a page of a list, no
+// more than the configured maximum.
+func (t *Transaction) pageSize() int {
+	size := t.Session.Settings.PageSize
+	if size <= 0 {
+		size = conf.DefaultPageSize
+	}
+	if t.Conf.MaxPageSize > 0 {
+		size = min(size, t.Conf.MaxPageSize)
+	}
+	return size
+}
+
+// linked reports whether the instance sent a Link header, which leaves
+// no limit in pg.
+func (p *pager) linked() bool {
+	return p.pg.Limit == 0
+}
+
+// links returns the links to the pages around the n entries fetched,
+// first and last being the IDs of the newest and oldest of them. They're
+// used when the instance doesn't send a Link header.
+func (p *pager) links(n int, first string, last string) render.Pager {
+	var links render.Pager
+
+	// The instance says whether there are older entries, even when it
+	// filtered some out of a page and sent fewer than asked for.
+	// Otherwise, there are when the page is full, or when it was reached
+	// by going back from them. Instances that don't page a list send all
+	// of it, more than asked for.
+	if p.linked() {
+		if p.pg.MaxID != "" {
+			links.NextLink = p.link("max_id", string(p.pg.MaxID))
+		}
+	} else if n > 0 && (n == p.limit || p.minID != "") && last != "" {
+		links.NextLink = p.link("max_id", last)
+	}
+
+	// The first page has nothing newer to go back to.
+	if p.maxID != "" || p.minID != "" {
+		prev := first
+		if p.linked() && p.pg.MinID != "" {
+			prev = p.pg.MinID
+		} else if n == 0 {
+			// Past the oldest entry, the page before is the one
+			// ending where this one started.
+			prev = p.maxID
+		}
+		if prev != "" {
+			links.PrevLink = p.link("min_id", prev)
+		}
+	}
+
+	return links
+}
+
+func (p *pager) link(key string, id string) string {
+	v := maps.Clone(p.query)
+	v.Del("max_id")
+	v.Del("min_id")
+	v.Set(key, id)
+	return p.path + "?" + v.Encode()
+}
+
+// offsetPager pages through search results, which instances page by
+// offset. pg is passed to the instance like pager's, in case it sends a
+// Link header.
+type offsetPager struct {
+	path   string
+	query  url.Values
+	offset int
+	limit  int
+	pg     masta.Pagination
+}
+
+func newOffsetPager(t *Transaction) *offsetPager {
+	q := t.R.URL.Query()
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	p := &offsetPager{
+		path:   t.R.URL.EscapedPath(),
+		query:  q,
+		offset: max(offset, 0),
+		limit:  t.pageSize(),
+	}
+	p.pg = masta.Pagination{Limit: int64(p.limit)}
+	return p
+}
+
+// links returns the links to the pages around the n results fetched. If
+// the instance sent a Link header, it says whether there are more, even
+// after a page shorter than asked for.
+func (p *offsetPager) links(n int) render.Pager {
+	var links render.Pager
+	more := n == p.limit
+	if p.pg.Limit == 0 {
+		more = p.pg.MaxID != ""
+	}
+	if more {
+		links.NextLink = p.link(p.offset + n)
+	}
+	if p.offset > 0 {
+		links.PrevLink = p.link(max(p.offset-p.limit, 0))
+	}
+	return links
+}
+
+func (p *offsetPager) link(offset int) string {
+	v := maps.Clone(p.query)
+	if offset > 0 {
+		v.Set("offset", strconv.Itoa(offset))
+	} else {
+		v.Del("offset")
+	}
+	return p.path + "?" + v.Encode()
+}
+
+func statusLinks(p *pager, statuses []*masta.Status) render.Pager {
+	if len(statuses) == 0 {
+		return p.links(0, "", "")
+	}
+	return p.links(len(statuses), statuses[0].ID, statuses[len(statuses)-1].ID)
+}
+
+// accountLinks pages through accounts. Instances page most lists of
+// accounts by the IDs of follows, blocks and so on, which only the Link
+// header has, so the IDs of the accounts are a guess without it.
+func accountLinks(p *pager, accounts []*masta.Account) render.Pager {
+	if len(accounts) == 0 {
+		return p.links(0, "", "")
+	}
+	return p.links(len(accounts), accounts[0].ID, accounts[len(accounts)-1].ID)
+}
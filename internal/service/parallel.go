@@ -0,0 +1,42 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// parallel runs fetches that don't depend on each other concurrently, so
+// that a page takes as long as its slowest request rather than all of them
+// together. It returns the first error, and the context the fetches are
+// given is cancelled as soon as one fails. Nil fetches are skipped, for
+// those a page only sometimes needs.
+func (t *Transaction) parallel(fetches ...func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(t.Ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+
+	for _, f := range fetches {
+		if f == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(f func(ctx context.Context) error) {
+			defer wg.Done()
+			if err := f(ctx); err != nil {
+				once.Do(func() {
+					first = err
+					cancel()
+				})
+			}
+		}(f)
+	}
+
+	wg.Wait()
+	return first
+}
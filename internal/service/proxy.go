@@ -0,0 +1,409 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"spiderden.org/8bloat/internal/conf"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// maxThumbPixels is the largest image that is scaled down, larger
+	// ones are served as they are rather than decoded. Decoded, it takes
+	// up to 16MB.
+	maxThumbPixels = 4 << 20
+
+	// maxThumbnailing is how many images are scaled down at once, other
+	// requests for thumbnails wait for their turn.
+	maxThumbnailing = 4
+
+	// mediaSweepInterval is how often expired media is removed from the
+	// cache, as long as media is being cached.
+	mediaSweepInterval = time.Hour
+)
+
+var errMediaURL = errors.New("media URL not allowed")
+
+// mediaProxy fetches remote media on behalf of users, so that remote
+// instances don't see their IP addresses. URLs are signed, so that it
+// can't be used to fetch anything else. Responses, and images scaled down
+// to the height they're shown at, are cached on disk.
+type mediaProxy struct {
+	key    []byte
+	dir    string
+	age    time.Duration
+	client *http.Client
+	thumbs chan struct{}
+	// swept is when the cache was last swept, in Unix nanoseconds.
+	swept atomic.Int64
+}
+
+func newMediaProxy(config conf.Configuration, secret string) (*mediaProxy, error) {
+	dir := filepath.Join(config.DatabasePath, "media")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Derive a separate key, so that signatures don't reveal anything
+	// about the session key.
+	key := sha256.Sum256([]byte("media proxy\x00" + secret))
+
+	p := &mediaProxy{
+		key:    key[:],
+		dir:    dir,
+		age:    config.MediaCacheAge,
+		client: newMediaClient(config),
+		thumbs: make(chan struct{}, maxThumbnailing),
+	}
+	p.sweep()
+	p.swept.Store(time.Now().UnixNano())
+	return p, nil
+}
+
+func (p *mediaProxy) sign(u string, height int) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(strconv.Itoa(height) + "\n" + u))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// URL implements render.MediaProxy. Only web URLs are proxied, others,
+// such as data: URLs, are returned as they are.
+func (p *mediaProxy) URL(u string, height int) string {
+	if pu, err := url.Parse(u); err != nil || pu.Scheme != "https" && pu.Scheme != "http" {
+		return u
+	}
+
+	v := url.Values{}
+	v.Set("url", u)
+	if height > 0 {
+		v.Set("h", strconv.Itoa(height))
+	}
+	v.Set("sig", p.sign(u, height))
+	return "/media/proxy?" + v.Encode()
+}
+
+func (p *mediaProxy) valid(u string, height int, sig string) bool {
+	return hmac.Equal([]byte(sig), []byte(p.sign(u, height)))
+}
+
+// path hashes the URL and height, so that thumbnails are cached apart
+// from the original.
+func (p *mediaProxy) path(u string, height int) string {
+	sum := sha256.Sum256([]byte(strconv.Itoa(height) + "\n" + u))
+	return filepath.Join(p.dir, hex.EncodeToString(sum[:]))
+}
+
+// get returns the media at u, from the cache if it's there.
+func (p *mediaProxy) get(ctx context.Context, client *http.Client, userAgent string, u string, height int) (ctype string, data []byte, modified time.Time, err error) {
+	path := p.path(u, height)
+
+	ctype, data, modified, err = p.load(path)
+	if err == nil {
+		return
+	}
+
+	ctype, data, err = fetchMedia(ctx, client, userAgent, u)
+	if err != nil {
+		return
+	}
+
+	if height > 0 {
+		select {
+		case p.thumbs <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+		tctype, tdata, ok := thumbnail(data, height)
+		<-p.thumbs
+		if ok {
+			ctype, data = tctype, tdata
+		}
+	}
+
+	modified = time.Now()
+	if serr := p.save(path, ctype, data); serr != nil {
+		// It can still be served, it will just be fetched again.
+		slog.Warn("error caching media", "err", serr)
+	}
+	p.sweepSometimes()
+
+	return
+}
+
+// Cache entries are the content type on the first line, followed by the
+// data.
+func (p *mediaProxy) load(path string) (ctype string, data []byte, modified time.Time, err error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	modified = stat.ModTime()
+	if time.Since(modified) > p.age {
+		os.Remove(path)
+		err = os.ErrNotExist
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	ctype, err = r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	ctype = strings.TrimSuffix(ctype, "\n")
+
+	data, err = io.ReadAll(r)
+	return
+}
+
+func (p *mediaProxy) save(path string, ctype string, data []byte) error {
+	tmp, err := os.CreateTemp(p.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.WriteString(ctype + "\n")
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// sweepSometimes sweeps the cache in the background, if it wasn't swept
+// for mediaSweepInterval.
+func (p *mediaProxy) sweepSometimes() {
+	last := p.swept.Load()
+	now := time.Now().UnixNano()
+	if now-last < int64(mediaSweepInterval) || !p.swept.CompareAndSwap(last, now) {
+		return
+	}
+	go p.sweep()
+}
+
+func (p *mediaProxy) sweep() {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return
+	}
+
+	for _, v := range entries {
+		info, err := v.Info()
+		if err != nil || v.IsDir() {
+			continue
+		}
+
+		if time.Since(info.ModTime()) > p.age {
+			os.Remove(filepath.Join(p.dir, v.Name()))
+		}
+	}
+}
+
+// newMediaClient returns the client media is fetched with. Remote
+// instances choose the URLs of media, and shouldn't be able to make 8bloat
+// fetch things that only it can reach, so the address of every connection
+// is checked once it's resolved, redirects included. For the same reason,
+// media isn't fetched through the proxy in the environment.
+func newMediaClient(config conf.Configuration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkMediaAddr,
+	}
+
+	return &http.Client{
+		Transport: &tripper{
+			conf: config,
+			underlying: &http.Transport{
+				DialContext:           dialer.DialContext,
+				ForceAttemptHTTP2:     true,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: 1 * time.Second,
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return checkMediaURL(req.URL)
+		},
+	}
+}
+
+// blockedNets are reachable only from this network, besides the loopback,
+// private and link-local ones the net package knows.
+var blockedNets = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("fc00::/7"),
+}
+
+// checkMediaAddr refuses connections to addresses that point to this
+// network rather than to another instance.
+func checkMediaAddr(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+
+	if !mediaAddrAllowed(ip) {
+		return errMediaURL
+	}
+	return nil
+}
+
+func mediaAddrAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, v := range blockedNets {
+		if v.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMediaURL refuses URLs that aren't for the web, or that name this
+// host. Where the others point to is checked when connecting.
+func checkMediaURL(u *url.URL) error {
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errMediaURL
+	}
+
+	host := u.Hostname()
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errMediaURL
+	}
+
+	return nil
+}
+
+func fetchMedia(ctx context.Context, client *http.Client, userAgent string, rawURL string) (ctype string, data []byte, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+
+	if err = checkMediaURL(u); err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New("media request failed: " + resp.Status)
+		return
+	}
+
+	ctype = resp.Header.Get("Content-Type")
+	switch strings.SplitN(ctype, "/", 2)[0] {
+	case "image", "video", "audio":
+	default:
+		err = errors.New("media has unexpected type " + ctype)
+		return
+	}
+
+	data, err = io.ReadAll(resp.Body)
+	return
+}
+
+// thumbnail scales the image down to height. ok is false if the image
+// can't be decoded, or is already small enough, and the original should
+// be used. GIFs are left as they are, only their first frame would be
+// scaled.
+func thumbnail(data []byte, height int) (ctype string, thumb []byte, ok bool) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format == "gif" || cfg.Height <= height || cfg.Width*cfg.Height > maxThumbPixels {
+		return
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	width := cfg.Width * height / cfg.Height
+	if width < 1 {
+		width = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	var buf bytes.Buffer
+	if o, ok := src.(interface{ Opaque() bool }); ok && o.Opaque() {
+		ctype = "image/jpeg"
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		ctype = "image/png"
+		err = png.Encode(&buf, dst)
+	}
+
+	if err != nil || buf.Len() >= len(data) {
+		return "", nil, false
+	}
+
+	return ctype, buf.Bytes(), true
+}
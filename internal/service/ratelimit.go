@@ -0,0 +1,154 @@
+package service
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"spiderden.org/8bloat/internal/conf"
+	"strings"
+	"sync"
+	"time"
+
+	"spiderden.org/8bloat/internal/render"
+)
+
+var errInstanceNotAllowed = errors.New("signing in to this instance is not allowed")
+
+// maxBuckets is how many clients a limiter tracks before it forgets the
+// ones that are back to a full bucket.
+const maxBuckets = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a token bucket per key. Each bucket holds up to Count tokens
+// and gains Count every Per, and a request takes one.
+type limiter struct {
+	mu      sync.Mutex
+	rate    conf.RateLimit
+	buckets map[string]*bucket
+}
+
+// newLimiter returns nil if the rate is not enabled, which allows
+// everything.
+func newLimiter(rate conf.RateLimit) *limiter {
+	if !rate.Enabled() {
+		return nil
+	}
+	return &limiter{rate: rate, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the bucket of key. If there's none, it returns
+// how long until there will be.
+func (l *limiter) allow(key string) (ok bool, retry time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	perToken := l.rate.Per.Seconds() / float64(l.rate.Count)
+
+	b, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now, perToken)
+		}
+		b = &bucket{tokens: float64(l.rate.Count), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.rate.Count), b.tokens+now.Sub(b.last).Seconds()/perToken)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * perToken * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets the buckets that have filled up again, they are the same
+// as new ones.
+func (l *limiter) sweep(now time.Time, perToken float64) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()/perToken >= float64(l.rate.Count) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// limits are the limiters of a configuration.
+type limits struct {
+	ip      *limiter
+	session *limiter
+	signin  *limiter
+}
+
+func newLimits(config conf.Configuration) *limits {
+	return &limits{
+		ip:      newLimiter(config.IPRateLimit),
+		session: newLimiter(config.SessionRateLimit),
+		signin:  newLimiter(config.SigninRateLimit),
+	}
+}
+
+func rateLimited(retry time.Duration) error {
+	return &render.RateLimitError{RetryAfter: retry}
+}
+
+// clientIP returns the address of the client, from header if it's set.
+// Each proxy appends the address it got the request from to
+// X-Forwarded-For, and whatever the client sent comes before, so the
+// address is counted from the end. hops is how many trusted proxies come
+// before the one in front of 8bloat, and whose entries are skipped.
+func clientIP(r *http.Request, header string, hops int) string {
+	if header != "" {
+		if v := strings.Join(r.Header.Values(header), ","); v != "" {
+			addrs := strings.Split(v, ",")
+			i := max(len(addrs)-1-hops, 0)
+			return strings.TrimSpace(addrs[i])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// instanceAllowed checks the instance against the allow and deny lists.
+// Entries match the domain and its subdomains, whatever the port. The
+// instance has to be a host and nothing else, a path, user info, query or
+// fragment would make the URLs built from it go somewhere other than the
+// host that was matched.
+func instanceAllowed(config *conf.Configuration, instance string) bool {
+	u, err := url.Parse("https://" + instance)
+	if err != nil || u.Host != instance {
+		return false
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+
+	matches := func(list []string) bool {
+		for _, v := range list {
+			if host == v || strings.HasSuffix(host, "."+v) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if matches(config.InstanceDeny) {
+		return false
+	}
+
+	return len(config.InstanceAllow) == 0 || matches(config.InstanceAllow)
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"spiderden.org/8bloat/internal/render"
+
+	"spiderden.org/masta"
+)
+
+const (
+	// maxRules is how many rules a user can have. They're kept with the
+	// settings, in the session.
+	maxRules = 50
+
+	// maxRuleRegexp is how long the regexp of a rule can be.
+	maxRuleRegexp = 256
+)
+
+// applyRules leaves out the statuses of the timeline that the user's
+// rules hide, and returns how many each rule hid. Whether the user
+// follows the accounts replied to is only asked if a rule needs it, and
+// without an answer, all of them are taken as followed.
+func (t *Transaction) applyRules(timeline string, statuses []*masta.Status) ([]*masta.Status, []render.RuleCount) {
+	rs := render.NewRuleSet(t.Session.Settings.Rules, timeline, t.Session.Identity().domain())
+	if rs.Empty() {
+		return statuses, nil
+	}
+
+	userID := t.Session.UserID()
+	var following map[string]bool
+	if ids := rs.RepliedTo(statuses, userID); len(ids) > 0 {
+		following = make(map[string]bool, len(ids))
+		rels, err := t.GetAccountRelationships(t.Ctx, ids)
+		if err != nil {
+			t.log.Warn("error getting relationships for rules", "err", err)
+			for _, id := range ids {
+				following[id] = true
+			}
+		}
+		for _, v := range rels {
+			following[string(v.ID)] = v.Following
+		}
+	}
+
+	return rs.Apply(statuses, userID, following)
+}
+
+// ruleFromForm reads the rule being added. It has to match something, a
+// rule for everything on a timeline would hide it. Accounts given without
+// a domain are taken to be on the user's own domain.
+func (t *Transaction) ruleFromForm() (*render.Rule, error) {
+	account := strings.TrimSpace(t.R.FormValue("account"))
+	rule := &render.Rule{
+		ID:       t.sfnode.Generate().String(),
+		Timeline: t.R.FormValue("timeline"),
+		Kind:     t.R.FormValue("kind"),
+		Account:  render.FullAcct(account, t.Session.Identity().domain()),
+		Regexp:   t.R.FormValue("regexp"),
+	}
+
+	switch rule.Timeline {
+	case "", "home", "direct", "local", "remote", "twkn", "tag":
+	default:
+		if id, ok := strings.CutPrefix(rule.Timeline, "list/"); !ok || id == "" {
+			return nil, errInvalidArgument
+		}
+	}
+
+	if !slices.Contains(render.RuleKinds, rule.Kind) {
+		return nil, errInvalidArgument
+	}
+
+	if len(rule.Regexp) > maxRuleRegexp {
+		return nil, errInvalidArgument
+	}
+	if _, err := regexp.Compile(rule.Regexp); err != nil {
+		return nil, errInvalidArgument
+	}
+
+	if rule.Kind == render.RuleAll && rule.Account == "" && rule.Regexp == "" {
+		return nil, errInvalidArgument
+	}
+
+	return rule, nil
+}
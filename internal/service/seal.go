@@ -0,0 +1,135 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"spiderden.org/8bloat/internal/conf"
+	"time"
+)
+
+const sessionLifetime = 365 * 24 * time.Hour
+
+var errSealedValue = errors.New("invalid sealed value")
+
+// sealer encrypts and authenticates values stored on the client, such as
+// the session cookie, using AES-GCM. Values are always sealed with the
+// current key. Values sealed with a previous key can still be opened until
+// the grace window after the key was rotated ends, so that rotating the
+// key doesn't sign everyone out at once.
+type sealer struct {
+	current  cipher.AEAD
+	previous []cipher.AEAD
+	rotated  time.Time
+	grace    time.Duration
+}
+
+func newSealer(config conf.Configuration, fallback string) (*sealer, error) {
+	key := config.SessionKey
+	if key == "" {
+		key = fallback
+	}
+
+	current, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sealer{
+		current: current,
+		rotated: config.SessionKeyRotated,
+		grace:   config.SessionKeyGrace,
+	}
+
+	for _, v := range config.SessionKeysPrevious {
+		aead, err := newAEAD(v)
+		if err != nil {
+			return nil, err
+		}
+		s.previous = append(s.previous, aead)
+	}
+
+	return s, nil
+}
+
+func newAEAD(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encodes v as JSON and seals it. The name is bound to the sealed
+// value, so it can't be replayed under another name.
+func (s *sealer) seal(name string, v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	plain := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(plain, uint64(time.Now().Unix()))
+	plain = append(plain, data...)
+
+	nonce := make([]byte, s.current.NonceSize(), s.current.NonceSize()+len(plain)+s.current.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(s.current.Seal(nonce, nonce, plain, []byte(name))), nil
+}
+
+// open reverses seal. If stale is true, the value was sealed with a
+// previous key and should be sealed again.
+func (s *sealer) open(name string, value string, v interface{}) (stale bool, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return false, errSealedValue
+	}
+
+	plain, err := openWith(s.current, name, data)
+	if err != nil && time.Since(s.rotated) < s.grace {
+		for _, aead := range s.previous {
+			if plain, err = openWith(aead, name, data); err == nil {
+				stale = true
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		return false, errSealedValue
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint64(plain[:8])), 0)
+	if time.Since(issued) > sessionLifetime {
+		return false, errSealedValue
+	}
+
+	return stale, json.Unmarshal(plain[8:], v)
+}
+
+func openWith(aead cipher.AEAD, name string, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errSealedValue
+	}
+
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(plain) < 8 {
+		return nil, errSealedValue
+	}
+
+	return plain, nil
+}
@@ -3,12 +3,14 @@ package service
 import (
 	"context"
 	"errors"
-	"fmt"
 	"github.com/bwmarrin/snowflake"
 	"github.com/julienschmidt/httprouter"
+	"log/slog"
+	"net"
 	"net/http"
 	"spiderden.org/8bloat/internal/conf"
 	"sync"
+	"sync/atomic"
 )
 
 func init() {
@@ -19,15 +21,36 @@ var (
 	errInvalidArgument  = errors.New("invalid argument")
 	errInvalidSession   = errors.New("invalid session")
 	errInvalidCSRFToken = errors.New("invalid csrf token")
+	errUnsupported      = errors.New("not supported by this instance")
 )
 
+// state is what's replaced when the configuration is reloaded. Requests
+// use the state that was current when they began, so they never see half
+// of a reload.
+type state struct {
+	cfg    conf.Configuration
+	client *http.Client
+	sfnode *snowflake.Node
+	sealer *sealer
+	store  SessionStore
+	apps   AppStore
+	feeds  FeedStore
+	proxy  *mediaProxy
+	limits *limits
+}
+
 type Service struct {
-	cfg        conf.Configuration
+	state      atomic.Pointer[state]
 	confch     chan conf.Configuration
 	confchonce sync.Once
 	servelock  sync.Mutex
-	client     *http.Client
-	sfnode     *snowflake.Node
+	caps       *capsCache
+	apiCache   *apiCache
+	metrics    *metrics
+
+	// Used in place of the session key if none is configured, so
+	// that reloading the config doesn't invalidate every session.
+	fallbackKey string
 }
 
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -42,9 +65,20 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r = r.WithContext(context.WithValue(r.Context(), "conf", s.cfg))
-	r = r.WithContext(context.WithValue(r.Context(), "client", s.client))
-	r = r.WithContext(context.WithValue(r.Context(), "sfnode", s.sfnode))
+	st := s.state.Load()
+
+	r = r.WithContext(context.WithValue(r.Context(), "conf", st.cfg))
+	r = r.WithContext(context.WithValue(r.Context(), "client", st.client))
+	r = r.WithContext(context.WithValue(r.Context(), "sfnode", st.sfnode))
+	r = r.WithContext(context.WithValue(r.Context(), "sealer", st.sealer))
+	r = r.WithContext(context.WithValue(r.Context(), "store", st.store))
+	r = r.WithContext(context.WithValue(r.Context(), "apps", st.apps))
+	r = r.WithContext(context.WithValue(r.Context(), "feeds", st.feeds))
+	r = r.WithContext(context.WithValue(r.Context(), "caps", s.caps))
+	r = r.WithContext(context.WithValue(r.Context(), "apicache", s.apiCache))
+	r = r.WithContext(context.WithValue(r.Context(), "proxy", st.proxy))
+	r = r.WithContext(context.WithValue(r.Context(), "metrics", s.metrics))
+	r = r.WithContext(context.WithValue(r.Context(), "limits", st.limits))
 
 	h(w, r, params)
 }
@@ -61,58 +95,173 @@ func (s *Service) StartAndListen(ctx context.Context, config conf.Configuration)
 
 	defer s.servelock.Unlock()
 
-	server := &http.Server{
-		Addr:    config.ListenAddress,
-		Handler: s,
+	if config.SessionKey == "" {
+		slog.Warn("session_key is not set, sessions will not survive a restart")
 	}
 
-	s.cfg = config
-
-	var err error
-	s.sfnode, err = snowflake.NewNode(int64(config.Node))
-	if err != nil {
-		return errors.New("unable to create snowflake node: " + err.Error())
+	if err := s.setup(config); err != nil {
+		return err
 	}
 
-	if config.AssetStamp == "random" || config.AssetStamp == "snowflake" {
-		s.cfg.AssetStamp = s.sfnode.Generate().Base64()
+	ln, err := net.Listen("tcp", config.ListenAddress)
+	if err != nil {
+		return err
 	}
 
-	errch := make(chan error)
+	errch := make(chan error, 1)
 	s.confchonce.Do(func() { s.confch = make(chan conf.Configuration) })
-	s.client = newClient(config)
-
-	go func() { errch <- server.ListenAndServe() }()
+	server := s.serve(ln, errch)
+	addr := config.ListenAddress
 
 	for {
 		select {
 		case err := <-errch:
 			return err
 		case <-ctx.Done():
-			go func() { fmt.Println(server.Shutdown(context.TODO())) }()
-			<-errch
+			if err := server.Shutdown(context.TODO()); err != nil {
+				slog.Error("error shutting down server", "err", err)
+			}
 			return nil
 		case config := <-s.confch:
-			go func() { server.Shutdown(context.TODO()) }()
-			<-errch
-
-			if config.AssetStamp == "random" || config.AssetStamp == "snowflake" {
-				config.AssetStamp = s.sfnode.Generate().Base64()
+			// A bad configuration leaves the old one in place, rather
+			// than stopping the service.
+			st, err := s.newState(config, s.state.Load())
+			if err != nil {
+				slog.Error("error reloading config, keeping the old one", "err", err)
+				continue
 			}
 
-			s.cfg = config
-			s.client = newClient(config)
-			s.sfnode, err = snowflake.NewNode(config.Node)
-			if err != nil {
-				return errors.New("error while reloading config and creating snowflake node: " + err.Error())
+			if config.ListenAddress != addr {
+				ln, err := net.Listen("tcp", config.ListenAddress)
+				if err != nil {
+					slog.Error("error listening on new address, still listening on the old one",
+						"address", config.ListenAddress, "old_address", addr, "err", err)
+				} else {
+					// Requests that already began are left to finish.
+					old := server
+					server = s.serve(ln, errch)
+					addr = config.ListenAddress
+					go func() {
+						if err := old.Shutdown(context.TODO()); err != nil {
+							slog.Error("error shutting down old server", "err", err)
+						}
+					}()
+				}
 			}
 
-			server = &http.Server{
-				Addr:    config.ListenAddress,
-				Handler: s,
+			s.state.Store(st)
+		}
+	}
+}
+
+// setup creates everything needed to serve requests with config, short
+// of listening.
+func (s *Service) setup(config conf.Configuration) error {
+	var err error
+	s.fallbackKey, err = NewRandID(32)
+	if err != nil {
+		return errors.New("unable to generate fallback session key: " + err.Error())
+	}
+
+	st, err := s.newState(config, nil)
+	if err != nil {
+		return err
+	}
+	s.state.Store(st)
+
+	s.caps = newCapsCache()
+	s.apiCache = newAPICache()
+	s.metrics = newMetrics()
+	return nil
+}
+
+// serve serves on ln until the server is shut down. Other errors are sent
+// to errch.
+func (s *Service) serve(ln net.Listener, errch chan<- error) *http.Server {
+	server := &http.Server{Handler: s}
+	go func() {
+		err := server.Serve(ln)
+		if !errors.Is(err, http.ErrServerClosed) {
+			select {
+			case errch <- err:
+			default:
 			}
+		}
+	}()
+	return server
+}
+
+// newState creates what's needed to serve requests with config. The
+// session store is kept from prev if it would be the same, since
+// recreating the memory store would sign everyone out, and so are the
+// rate limits, which would otherwise start over.
+func (s *Service) newState(config conf.Configuration, prev *state) (*state, error) {
+	st := &state{
+		cfg:    config,
+		client: newClient(config),
+	}
+
+	if prev != nil && config.IPRateLimit == prev.cfg.IPRateLimit &&
+		config.SessionRateLimit == prev.cfg.SessionRateLimit &&
+		config.SigninRateLimit == prev.cfg.SigninRateLimit {
+		st.limits = prev.limits
+	} else {
+		st.limits = newLimits(config)
+	}
+
+	var err error
+	st.sfnode, err = snowflake.NewNode(int64(config.Node))
+	if err != nil {
+		return nil, errors.New("unable to create snowflake node: " + err.Error())
+	}
+
+	if config.AssetStamp == "random" || config.AssetStamp == "snowflake" {
+		st.cfg.AssetStamp = st.sfnode.Generate().Base64()
+	}
+
+	st.sealer, err = newSealer(config, s.fallbackKey)
+	if err != nil {
+		return nil, errors.New("unable to create session sealer: " + err.Error())
+	}
+
+	if prev != nil && config.SessionStore == prev.cfg.SessionStore && config.DatabasePath == prev.cfg.DatabasePath {
+		st.store = prev.store
+		st.apps = prev.apps
+		st.feeds = prev.feeds
+	} else {
+		st.store, err = newStore(config)
+		if err != nil {
+			return nil, errors.New("unable to create session store: " + err.Error())
+		}
 
-			go func() { errch <- server.ListenAndServe() }()
+		st.apps, err = newAppStore(config)
+		if err != nil {
+			return nil, errors.New("unable to create app store: " + err.Error())
 		}
+
+		st.feeds, err = newFeedStore(config)
+		if err != nil {
+			return nil, errors.New("unable to create feed store: " + err.Error())
+		}
+	}
+
+	st.proxy, err = s.newMediaProxy(config)
+	if err != nil {
+		return nil, errors.New("unable to create media proxy: " + err.Error())
+	}
+
+	return st, nil
+}
+
+// newMediaProxy returns nil if the proxy isn't enabled.
+func (s *Service) newMediaProxy(config conf.Configuration) (*mediaProxy, error) {
+	if !config.MediaProxy {
+		return nil, nil
+	}
+
+	key := config.SessionKey
+	if key == "" {
+		key = s.fallbackKey
 	}
+	return newMediaProxy(config, key)
 }
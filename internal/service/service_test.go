@@ -0,0 +1,912 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"spiderden.org/8bloat/internal/conf"
+	"spiderden.org/8bloat/internal/render"
+	"spiderden.org/8bloat/internal/upstream"
+
+	"spiderden.org/masta"
+)
+
+func TestSignin(t *testing.T) {
+	c := newTestClient(t)
+
+	// Pages that need a session send the user to sign in.
+	c.get("/").redirect(t, "GET /", "/signin")
+	c.golden("signin", c.page("/signin"))
+
+	c.signin()
+
+	sess := c.session()
+	ident := sess.Identity()
+	if ident == nil {
+		t.Fatal("no active identity after signing in")
+	}
+	if ident.UserID != "1" || ident.Acct != "alice@"+c.inst.host() {
+		t.Errorf("signed in as %s (%s), want alice (1)", ident.Acct, ident.UserID)
+	}
+	if sess.Pending != nil {
+		t.Error("pending identity left in the session")
+	}
+
+	c.golden("root", c.page("/"))
+	c.golden("nav", c.page("/nav"))
+
+	// The app is reused by the next sign in.
+	apps := len(c.inst.apps)
+	c.signin()
+	if len(c.inst.apps) != apps {
+		t.Errorf("signing in again registered another app")
+	}
+	if n := len(c.session().Identities); n != 1 {
+		t.Errorf("signing in to the same account again left %d identities", n)
+	}
+
+	c.post("/signout", nil).redirect(t, "POST /signout", "/")
+	if _, err := c.getSession(); err == nil {
+		t.Error("session still valid after signing out")
+	}
+}
+
+func TestPages(t *testing.T) {
+	c := newSignedInClient(t)
+
+	pages := []struct {
+		name string
+		path string
+	}{
+		{"timeline-home", "/timeline/home"},
+		{"timeline-local", "/timeline/local"},
+		{"thread", "/thread/10"},
+		{"notifications", "/notifications"},
+		{"notifications-mentions", "/notifications?type=mentions"},
+		{"user", "/user/2"},
+		{"lists", "/lists"},
+		{"list", "/list/30"},
+		{"filters", "/filters"},
+		{"settings", "/settings"},
+	}
+
+	for _, v := range pages {
+		t.Run(v.name, func(t *testing.T) {
+			c.t = t
+			c.golden(v.name, c.page(v.path))
+		})
+	}
+}
+
+func TestSigninAppCheck(t *testing.T) {
+	c := newSignedInClient(t)
+
+	// A new app isn't checked again before it's a day old.
+	c.signin()
+	if c.inst.clientGrants != 0 {
+		t.Errorf("new app checked %d times", c.inst.clientGrants)
+	}
+
+	st := c.s.state.Load()
+	key := appKey(&st.cfg, c.inst.host())
+	app, err := st.apps.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Verified = time.Now().Add(-appVerifyAge)
+	if err = st.apps.Put(key, app); err != nil {
+		t.Fatal(err)
+	}
+
+	// If the instance can't check it, the app is used all the same.
+	c.inst.clientGrantsDown = true
+	apps := len(c.inst.apps)
+	c.signin()
+	if c.inst.clientGrants != 1 || len(c.inst.apps) != apps {
+		t.Errorf("app checked %d times, %d apps registered, want once and none", c.inst.clientGrants, len(c.inst.apps)-apps)
+	}
+}
+
+func TestPost(t *testing.T) {
+	c := newSignedInClient(t)
+
+	res := c.postMultipart("/post", url.Values{
+		"content":    {"Posted through 8bloat."},
+		"visibility": {"unlisted"},
+		"referrer":   {"/timeline/home"},
+	}, map[string][2]string{
+		"attachments": {"cat.png", "not really a png"},
+	})
+	res.redirect(t, "POST /post", "/timeline/home")
+
+	st := c.inst.statuses[0]
+	if st.Content != "<p>Posted through 8bloat.</p>" || st.Visibility != "unlisted" {
+		t.Errorf("posted %q with visibility %s", st.Content, st.Visibility)
+	}
+	if len(st.MediaAttachments) != 1 || !strings.HasSuffix(st.MediaAttachments[0].URL, "/cat.png") {
+		t.Errorf("posted with attachments %v, want cat.png", st.MediaAttachments)
+	}
+
+	if !strings.Contains(c.page("/timeline/home"), "Posted through 8bloat.") {
+		t.Error("new post not on the home timeline")
+	}
+
+	// Replies go back to the thread.
+	res = c.postMultipart("/post", url.Values{
+		"content":     {"A reply."},
+		"reply_to_id": {"11"},
+	}, nil)
+	reply := c.inst.statuses[0]
+	res.redirect(t, "POST /post", "/thread/11#status-"+reply.ID)
+	if reply.InReplyToID == nil || *reply.InReplyToID != "11" {
+		t.Errorf("reply posted in reply to %v, want 11", reply.InReplyToID)
+	}
+}
+
+func TestPostRetry(t *testing.T) {
+	c := newSignedInClient(t)
+	files := map[string][2]string{"attachment_0": {"cat.png", "not really a png"}}
+
+	// The instance rejects a post without text, after the upload.
+	c.postMultipart("/post", url.Values{"alt_text_0": {"A cat."}}, files)
+	if len(c.inst.media) != 1 {
+		t.Fatalf("%d attachments uploaded, want 1", len(c.inst.media))
+	}
+
+	// The retry reuses the upload, and clears its description.
+	c.postMultipart("/post", url.Values{
+		"content":    {"Posted again."},
+		"alt_text_0": {""},
+		"referrer":   {"/timeline/home"},
+	}, files).redirect(t, "POST /post", "/timeline/home")
+	if len(c.inst.media) != 1 {
+		t.Errorf("%d attachments uploaded after retrying, want 1", len(c.inst.media))
+	}
+	st := c.inst.statuses[0]
+	if len(st.MediaAttachments) != 1 || st.MediaAttachments[0].Description != "" {
+		t.Errorf("retried post has attachments %v, want one without a description", st.MediaAttachments)
+	}
+}
+
+func TestLike(t *testing.T) {
+	c := newSignedInClient(t)
+	st := c.inst.findStatus("12")
+
+	c.post("/like/12", url.Values{"referrer": {"/timeline/home"}}).
+		redirect(t, "POST /like/12", "/timeline/home#status-12")
+	if !st.Favourited || st.FavouritesCount != 1 {
+		t.Fatalf("status favourited %v with %d favourites after liking", st.Favourited, st.FavouritesCount)
+	}
+	c.golden("thread-liked", c.page("/thread/12"))
+
+	c.post("/unlike/12", url.Values{"referrer": {"/timeline/home"}}).
+		redirect(t, "POST /unlike/12", "/timeline/home#status-12")
+	if st.Favourited || st.FavouritesCount != 0 {
+		t.Fatalf("status favourited %v with %d favourites after unliking", st.Favourited, st.FavouritesCount)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	c := newSignedInClient(t)
+
+	res := c.post("/like/12", url.Values{"csrf_token": {"wrong"}, "referrer": {"/timeline/home"}})
+	if !strings.Contains(res.Body, errInvalidCSRFToken.Error()) {
+		t.Errorf("liking with the wrong CSRF token didn't fail")
+	}
+	if c.inst.findStatus("12").Favourited {
+		t.Error("status liked with the wrong CSRF token")
+	}
+}
+
+func TestSettings(t *testing.T) {
+	c := newSignedInClient(t)
+
+	c.post("/settings", url.Values{
+		"visibility":            {"private"},
+		"format":                {"text/markdown"},
+		"thread_tree":           {"true"},
+		"mask_nsfw":             {"true"},
+		"notification_interval": {"60"},
+		"theme":                 {"foil"},
+		"anti_dopamine_mode":    {"true"},
+		"time_zone":             {"Europe/Berlin"},
+	}).redirect(t, "POST /settings", "/")
+
+	s := c.session().Settings
+	if s.DefaultVisibility != "private" || s.DefaultFormat != "text/markdown" || !s.ThreadTree ||
+		!s.MaskNSFW || s.NotificationInterval != 60 || s.Theme != "foil" || !s.AntiDopamineMode ||
+		s.TimeZone != "Europe/Berlin" {
+		t.Errorf("settings not saved: %+v", s)
+	}
+
+	c.golden("settings-saved", c.page("/settings"))
+
+	// Anti-dopamine mode hides likes from the notifications.
+	if strings.Contains(c.page("/notifications"), "liked your post") {
+		t.Error("likes shown in anti-dopamine mode")
+	}
+
+	res := c.post("/settings", url.Values{"time_zone": {"Nowhere/Special"}})
+	if !strings.Contains(res.Body, errInvalidArgument.Error()) {
+		t.Error("settings saved with an unknown time zone")
+	}
+}
+
+func TestFilters(t *testing.T) {
+	c := newSignedInClient(t)
+
+	c.post("/filter", url.Values{
+		"keywords":   {"politics\nCarol"},
+		"whole_word": {"true"},
+		"context":    {"home", "thread"},
+		"action":     {"hide"},
+		"referrer":   {"/filters"},
+	}).redirect(t, "POST /filter", "/filters")
+
+	// Instances without filters v2 get a filter for each keyword.
+	var ids []string
+	for _, v := range c.inst.filters {
+		if v.Phrase == "politics" || v.Phrase == "Carol" {
+			if !v.WholeWord || !v.Irreversible || !slices.Equal(v.Context, []string{"home", "thread"}) {
+				t.Errorf("filter %q created as %+v", v.Phrase, v)
+			}
+			ids = append(ids, v.ID)
+		}
+	}
+	if len(ids) != 2 {
+		t.Fatalf("%d filters created for 2 keywords", len(ids))
+	}
+	if !strings.Contains(c.page("/filters"), "politics") {
+		t.Error("new filter not listed")
+	}
+
+	// They're matched here, and only where they apply.
+	if strings.Contains(c.page("/timeline/home"), "Carol&#39;s own post.") {
+		t.Error("hidden status shown on the home timeline")
+	}
+	if !strings.Contains(c.page("/timeline/local"), "Carol&#39;s own post.") {
+		t.Error("status hidden on the local timeline, which the filter isn't for")
+	}
+	// The status a thread is about is only ever warned about.
+	if body := c.page("/thread/12"); !strings.Contains(body, "Filtered: Carol") ||
+		!strings.Contains(body, "Carol&#39;s own post.") {
+		t.Error("status of the thread not collapsed with a warning")
+	}
+
+	c.post("/filter", url.Values{
+		"keywords": {"bob here"},
+		"context":  {"home"},
+		"action":   {"warn"},
+		"referrer": {"/timeline/home"},
+	}).redirect(t, "POST /filter", "/timeline/home")
+	c.golden("timeline-filtered", c.page("/timeline/home"))
+
+	for _, v := range []url.Values{
+		{"keywords": {" \n"}, "context": {"home"}, "action": {"warn"}},
+		{"keywords": {"x"}, "action": {"warn"}},
+		{"keywords": {"x"}, "context": {"home", "elsewhere"}, "action": {"warn"}},
+		{"keywords": {"x"}, "context": {"home"}, "action": {"drop"}},
+		{"keywords": {"x"}, "context": {"home"}, "action": {"warn"}, "expires_in": {"-60"}},
+	} {
+		res := c.post("/filter", v)
+		if !strings.Contains(res.Body, errInvalidArgument.Error()) {
+			t.Errorf("filter created from %v", v)
+		}
+	}
+
+	c.post("/unfilter/"+ids[0], url.Values{"referrer": {"/filters"}}).redirect(t, "POST /unfilter", "/filters")
+	if len(c.inst.filters) != 3 {
+		t.Errorf("%d filters left after removing one of 4", len(c.inst.filters))
+	}
+}
+
+func TestFiltersV2(t *testing.T) {
+	c := newTestClient(t)
+	c.inst.software = "mastodon"
+	c.inst.version = "4.2.0"
+	c.signin()
+
+	c.post("/filter", url.Values{
+		"title":      {"Greetings"},
+		"keywords":   {"hello\nhi alice"},
+		"context":    {"home", "public"},
+		"action":     {"warn"},
+		"expires_in": {"3600"},
+		"referrer":   {"/filters"},
+	}).redirect(t, "POST /filter", "/filters")
+
+	if len(c.inst.filtersV2) != 1 {
+		t.Fatalf("%d filters created, want one with both keywords", len(c.inst.filtersV2))
+	}
+	f := c.inst.filtersV2[0]
+	if f.Title != "Greetings" || len(f.Keywords) != 2 || f.FilterAction != "warn" || f.ExpiresAt == nil {
+		t.Errorf("filter created as %+v", f)
+	}
+
+	// What the instance says was filtered is collapsed.
+	body := c.page("/timeline/home")
+	if n := strings.Count(body, "Filtered: Greetings"); n != 2 {
+		t.Errorf("%d statuses collapsed, want 2", n)
+	}
+	if body := c.page("/filters"); !strings.Contains(body, "<b>Greetings</b>: hello*, hi alice*") ||
+		!strings.Contains(body, `name="title"`) {
+		t.Error("filter not listed with its title and keywords")
+	}
+
+	c.post("/unfilter/"+f.ID, url.Values{"referrer": {"/filters"}}).redirect(t, "POST /unfilter", "/filters")
+	if len(c.inst.filtersV2) != 0 {
+		t.Error("filter not removed")
+	}
+	if strings.Contains(c.page("/timeline/home"), "Filtered:") {
+		t.Error("statuses still collapsed after removing the filter")
+	}
+}
+
+func TestRules(t *testing.T) {
+	c := newSignedInClient(t)
+
+	// Carol boosts Bob's reply, and replies to herself and to Bob, whom
+	// Alice follows.
+	bob, carol := c.inst.accounts["2"], c.inst.accounts["3"]
+	boost := c.inst.status("50", carol, "", fakeEpoch.Add(4*time.Hour))
+	boost.Reblog = c.inst.findStatus("11")
+	toSelf := c.inst.status("51", carol, "<p>Carol again.</p>", fakeEpoch.Add(5*time.Hour))
+	toSelf.InReplyToID, toSelf.InReplyToAccountID = &carol.ID, &carol.ID
+	toBob := c.inst.status("52", carol, "<p>Carol to Bob.</p>", fakeEpoch.Add(6*time.Hour))
+	toBob.InReplyToID, toBob.InReplyToAccountID = &bob.ID, &bob.ID
+	c.inst.statuses = append([]*apiStatus{toBob, toSelf, boost}, c.inst.statuses...)
+	c.inst.following["2"] = true
+
+	for _, v := range []url.Values{
+		{"kind": {"boosts"}, "account": {"@carol"}, "timeline": {"home"}},
+		{"kind": {"stranger_replies"}, "timeline": {"home"}},
+		{"kind": {"no_media"}, "timeline": {"list/30"}},
+		{"regexp": {"(?i)^hello"}, "timeline": {"local"}},
+	} {
+		v.Set("referrer", "/rules")
+		c.post("/rule", v).redirect(t, "POST /rule", "/rules")
+	}
+	rules := c.session().Settings.Rules
+	if len(rules) != 4 {
+		t.Fatalf("%d rules saved, want 4", len(rules))
+	}
+	if want := "carol@" + c.inst.host(); rules[0].Account != want {
+		t.Errorf("rule saved for %q, want %q", rules[0].Account, want)
+	}
+	c.golden("rules", c.page("/rules"))
+
+	body := c.page("/timeline/home")
+	if !strings.Contains(body, "Carol to Bob.") || !strings.Contains(body, "Carol&#39;s own post.") {
+		t.Error("status no rule matches hidden on the home timeline")
+	}
+	if strings.Contains(body, "Carol again.") || strings.Contains(body, "retweet-container") {
+		t.Error("status a rule matches shown on the home timeline")
+	}
+	c.golden("timeline-rules", body)
+
+	body = c.page("/timeline/local")
+	if strings.Contains(body, "Hello from Alice.") || !strings.Contains(body, "Carol again.") {
+		t.Error("rules for the local timeline not applied to it alone")
+	}
+	if !strings.Contains(body, "posts matching /(?i)^hello/ (1)") {
+		t.Error("local timeline doesn't say what the rules hid")
+	}
+	if strings.Contains(c.page("/timeline/list?list=30"), "Hi Alice, Bob here.") {
+		t.Error("status without media shown on the list")
+	}
+
+	for _, v := range []url.Values{
+		{},
+		{"kind": {"everything"}},
+		{"regexp": {"("}},
+		{"kind": {"boosts"}, "timeline": {"list/"}},
+		{"kind": {"boosts"}, "timeline": {"elsewhere"}},
+	} {
+		res := c.post("/rule", v)
+		if !strings.Contains(res.Body, errInvalidArgument.Error()) {
+			t.Errorf("rule added from %v", v)
+		}
+	}
+
+	// Saving the settings keeps the rules.
+	c.post("/settings", url.Values{"theme": {"foil"}}).redirect(t, "POST /settings", "/")
+	rules = c.session().Settings.Rules
+	if len(rules) != 4 {
+		t.Fatalf("%d rules left after saving the settings", len(rules))
+	}
+
+	c.post("/unrule/"+rules[0].ID, url.Values{"referrer": {"/rules"}}).redirect(t, "POST /unrule", "/rules")
+	if n := len(c.session().Settings.Rules); n != 3 {
+		t.Errorf("%d rules left after removing one of 4", n)
+	}
+	if !strings.Contains(c.page("/timeline/home"), "retweet-container") {
+		t.Error("boost still hidden after removing its rule")
+	}
+}
+
+func TestRulesAccountDomain(t *testing.T) {
+	// The API is served from another host than the one accounts are on.
+	c := newTestClient(t)
+	c.inst.me.URL = "https://example.org/users/alice"
+	c.signin()
+
+	if got := c.session().Identity().Acct; got != "alice@example.org" {
+		t.Errorf("signed in as %q, want alice@example.org", got)
+	}
+
+	c.post("/rule", url.Values{"kind": {"boosts"}, "account": {"carol"}, "referrer": {"/rules"}}).
+		redirect(t, "POST /rule", "/rules")
+	if rules := c.session().Settings.Rules; len(rules) != 1 || rules[0].Account != "carol@example.org" {
+		t.Errorf("rules saved as %+v, want one for carol@example.org", rules)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	c := newSignedInClient(t)
+
+	// 25 more posts by Bob, who is on the list, newest first.
+	bob := c.inst.accounts["2"]
+	var more []*apiStatus
+	for i := 25; i > 0; i-- {
+		id := strconv.Itoa(1000 + i)
+		more = append(more, c.inst.status(id, bob, "<p>Post "+id+".</p>", fakeEpoch.Add(time.Duration(i)*24*time.Hour)))
+	}
+	c.inst.statuses = append(more, c.inst.statuses...)
+
+	prev, next := pageLinks(c.page("/timeline/list?list=30"))
+	if prev != "" || next != "/timeline/list?list=30&max_id=1006" {
+		t.Fatalf("first page links to %q and %q", prev, next)
+	}
+
+	body := c.page(next)
+	if !strings.Contains(body, "Post 1005.") || !strings.Contains(body, "Hi Alice, Bob here.") {
+		t.Error("second page is missing the oldest posts")
+	}
+	if strings.Contains(body, "Carol&#39;s own post.") {
+		t.Error("post by someone not on the list shown on the list timeline")
+	}
+	prev, next = pageLinks(body)
+	if prev != "/timeline/list?list=30&min_id=1005" || next != "" {
+		t.Fatalf("last page links to %q and %q", prev, next)
+	}
+
+	body = c.page(prev)
+	if !strings.Contains(body, "Post 1025.") || !strings.Contains(body, "Post 1006.") || strings.Contains(body, "Post 1005.") {
+		t.Error("going back didn't show the first page")
+	}
+	prev, next = pageLinks(body)
+	if prev != "/timeline/list?list=30&min_id=1025" || next != "/timeline/list?list=30&max_id=1006" {
+		t.Errorf("first page reached going back links to %q and %q", prev, next)
+	}
+
+	// A page the instance sent short still links to the next one.
+	c.inst.withheld["1010"] = true
+	_, next = pageLinks(c.page("/timeline/list?list=30"))
+	if next != "/timeline/list?list=30&max_id=1006" {
+		t.Errorf("short first page links to %q", next)
+	}
+	delete(c.inst.withheld, "1010")
+
+	// Other parameters are kept, and escaped.
+	_, next = pageLinks(c.page("/user/2?x=a%26b"))
+	if next != "/user/2?max_id=1006&x=a%26b" {
+		t.Errorf("user page links to %q", next)
+	}
+
+	// Pages are as long as the user wants, up to the configured
+	// maximum.
+	c.post("/settings", url.Values{"page_size": {"10"}}).redirect(t, "POST /settings", "/")
+	_, next = pageLinks(c.page("/timeline/list?list=30"))
+	if next != "/timeline/list?list=30&max_id=1016" {
+		t.Errorf("first page of 10 links to %q", next)
+	}
+
+	res := c.post("/settings", url.Values{"page_size": {"41"}})
+	if !strings.Contains(res.Body, errInvalidArgument.Error()) {
+		t.Error("page size over the maximum saved")
+	}
+}
+
+var pageLink = regexp.MustCompile(`<a href="([^"]*)" target="_self">\[(prev|next)\]</a>`)
+
+// pageLinks returns the links to the pages before and after the page.
+func pageLinks(body string) (prev string, next string) {
+	for _, m := range pageLink.FindAllStringSubmatch(body, -1) {
+		if m[2] == "prev" {
+			prev = html.UnescapeString(m[1])
+		} else {
+			next = html.UnescapeString(m[1])
+		}
+	}
+	return
+}
+
+// session returns the session of the client, from the store.
+func (c *testClient) session() *Session {
+	c.t.Helper()
+
+	sess, err := c.getSession()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return sess
+}
+
+func (c *testClient) getSession() (*Session, error) {
+	u, _ := url.Parse(testWebsite)
+	for _, v := range c.jar.Cookies(u) {
+		if v.Name != "session" {
+			continue
+		}
+
+		var ref sessionRef
+		st := c.s.state.Load()
+		if _, err := st.sealer.open("session", v.Value, &ref); err != nil {
+			return nil, err
+		}
+		return st.store.Get(ref.ID)
+	}
+	return nil, errInvalidSession
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	old := testConfig()
+	old.SessionKey = "the old key"
+	s, err := newSealer(old, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := s.seal("session", sessionRef{ID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The grace window starts when the key was rotated, however long
+	// before that the cookie was issued.
+	for _, v := range []struct {
+		rotated time.Duration
+		grace   time.Duration
+		ok      bool
+	}{
+		{time.Hour, 24 * time.Hour, true},
+		{48 * time.Hour, 24 * time.Hour, false},
+		{0, 0, false},
+	} {
+		config := testConfig()
+		config.SessionKeysPrevious = []string{old.SessionKey}
+		config.SessionKeyRotated = time.Now().Add(-v.rotated)
+		config.SessionKeyGrace = v.grace
+
+		s, err := newSealer(config, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ref sessionRef
+		stale, err := s.open("session", sealed, &ref)
+		if ok := err == nil && stale && ref.ID == "1"; ok != v.ok {
+			t.Errorf("rotated %v ago with a grace of %v: opened %v, want %v (err %v)", v.rotated, v.grace, ok, v.ok, err)
+		}
+	}
+}
+
+func TestNodeInfoElsewhere(t *testing.T) {
+	c := newTestClient(t)
+
+	fetched := false
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+	}))
+	defer other.Close()
+	c.inst.nodeInfoHref = other.URL + "/nodeinfo/2.1"
+
+	c.signin()
+	c.page("/timeline/home")
+	if fetched {
+		t.Error("nodeinfo fetched from another host than the instance")
+	}
+}
+
+func TestMediaProxyLocal(t *testing.T) {
+	c := newTestClient(t)
+
+	config := testConfig()
+	config.DatabasePath = t.TempDir()
+	config.MediaCacheAge = time.Hour
+	px, err := newMediaProxy(config, config.SessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.s.state.Load().proxy = px
+
+	fetched := false
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+		w.Header().Set("Content-Type", "image/png")
+	}))
+	defer local.Close()
+
+	res := c.get(px.URL(local.URL+"/cat.png", 0))
+	if res.Code != http.StatusBadGateway || fetched {
+		t.Errorf("proxying a local URL: status %d, fetched %v", res.Code, fetched)
+	}
+
+	for _, v := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"93.184.215.14", true},
+		{"2606:2800:21f:cb07:6820:80da:af6b:8b2c", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"0.1.2.3", false},
+		{"::1", false},
+		{"fd12:3456::1", false},
+		{"fe80::1", false},
+		{"::ffff:192.168.1.1", false},
+	} {
+		if ok := mediaAddrAllowed(netip.MustParseAddr(v.addr)); ok != v.ok {
+			t.Errorf("media from %s allowed %v, want %v", v.addr, ok, v.ok)
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	c := newSignedInClient(t)
+
+	// The user's page caches their account with its relationship.
+	c.page("/user/1")
+	c.postMultipart("/profile", url.Values{"name": {"Alice"}, "bio": {"Still Alice."}}, nil).
+		redirect(t, "POST /profile", "/profile")
+	if !strings.Contains(c.page("/user/1"), "Still Alice.") {
+		t.Error("user page still has the old bio after editing the profile")
+	}
+}
+
+func TestCapsProbeFailed(t *testing.T) {
+	var probes atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		<-release
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	mc := masta.NewClient(&masta.Config{Server: srv.URL})
+	up := upstream.New(mc)
+	cc := newCapsCache()
+
+	// Concurrent requests share one probe, and a cancelled request
+	// doesn't fail it for the others.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if caps := cc.get(ctx, "fake.test", up); caps.Software != upstream.DefaultCaps().Software {
+				t.Errorf("failed probe found %q", caps.Software)
+			}
+		}()
+	}
+	for probes.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// The failure is kept for a while, the instance isn't probed on
+	// every request.
+	cc.get(context.Background(), "fake.test", up)
+	if n := probes.Load(); n != 1 {
+		t.Errorf("instance probed %d times, want 1", n)
+	}
+	if e := cc.entries["fake.test"]; time.Until(e.expires) > capsRetry {
+		t.Errorf("failed probe kept for %v", time.Until(e.expires))
+	}
+}
+
+func TestInstanceAllowed(t *testing.T) {
+	config := testConfig()
+	config.InstanceAllow = []string{"allowed.org"}
+	config.InstanceDeny = []string{"denied.allowed.org"}
+
+	for _, v := range []struct {
+		instance string
+		ok       bool
+	}{
+		{"allowed.org", true},
+		{"social.allowed.org", true},
+		{"Allowed.Org.", true},
+		{"allowed.org:8443", true},
+		{"evil.com", false},
+		{"notallowed.org", false},
+		{"denied.allowed.org", false},
+		{"denied.allowed.org:443", false},
+		{"denied.allowed.org/", false},
+		{"evil.com/x.allowed.org", false},
+		{"evil.com#.allowed.org", false},
+		{"evil.com?.allowed.org", false},
+		{"evil.com@allowed.org", false},
+	} {
+		if ok := instanceAllowed(&config, v.instance); ok != v.ok {
+			t.Errorf("instance %q allowed %v, want %v", v.instance, ok, v.ok)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, v := range []struct {
+		header string
+		values []string
+		hops   int
+		want   string
+	}{
+		{"", []string{"192.0.2.1"}, 0, "198.51.100.1"},
+		{"X-Forwarded-For", nil, 0, "198.51.100.1"},
+		{"X-Forwarded-For", []string{"192.0.2.1"}, 0, "192.0.2.1"},
+		{"X-Forwarded-For", []string{"203.0.113.9, 192.0.2.1"}, 0, "192.0.2.1"},
+		{"X-Forwarded-For", []string{"203.0.113.9", "192.0.2.1"}, 0, "192.0.2.1"},
+		{"X-Forwarded-For", []string{"203.0.113.9, 192.0.2.1, 192.0.2.200"}, 1, "192.0.2.1"},
+		{"X-Forwarded-For", []string{"192.0.2.1"}, 2, "192.0.2.1"},
+		{"X-Real-IP", []string{"192.0.2.1"}, 0, "192.0.2.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, testWebsite+"/", nil)
+		r.RemoteAddr = "198.51.100.1:4321"
+		for _, h := range v.values {
+			r.Header.Add(v.header, h)
+		}
+
+		if got := clientIP(r, v.header, v.hops); got != v.want {
+			t.Errorf("%s %q with %d hops: got %s, want %s", v.header, v.values, v.hops, got, v.want)
+		}
+	}
+}
+
+func TestListSearch(t *testing.T) {
+	c := newSignedInClient(t)
+	c.inst.account("4", "dom", "Dom")
+	c.inst.listAccounts["30"] = []string{"2", "3"}
+	for _, id := range []string{"2", "3", "4"} {
+		c.inst.following[id] = true
+	}
+
+	// Bob is in the list, but not on this page of it.
+	body := c.page("/list/30?max_id=2&q=o")
+	for id, want := range map[string]bool{"2": false, "3": false, "4": true} {
+		if got := strings.Contains(body, "/list/30/adduser?uid="+id); got != want {
+			t.Errorf("account %s offered to add %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestMediaProxyCache(t *testing.T) {
+	config := testConfig()
+	config.DatabasePath = t.TempDir()
+	config.MediaCacheAge = time.Hour
+	px, err := newMediaProxy(config, config.SessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u := "data:image/png;base64,AAAA"; px.URL(u, 0) != u {
+		t.Errorf("data: URL proxied as %s", px.URL(u, 0))
+	}
+
+	// Only the first frame of a GIF would be scaled down.
+	var buf bytes.Buffer
+	frame := image.NewPaletted(image.Rect(0, 0, 100, 100), palette.Plan9)
+	if err := gif.EncodeAll(&buf, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := thumbnail(buf.Bytes(), 10); ok {
+		t.Error("GIF scaled down")
+	}
+
+	// Caching media sweeps the expired media once in a while.
+	expired := filepath.Join(config.DatabasePath, "media", "expired")
+	if err := os.WriteFile(expired, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * config.MediaCacheAge)
+	if err := os.Chtimes(expired, old, old); err != nil {
+		t.Fatal(err)
+	}
+	px.sweepSometimes()
+	if _, err := os.Stat(expired); err != nil {
+		t.Fatal("media swept again right after being swept")
+	}
+
+	px.swept.Store(old.UnixNano())
+	px.sweepSometimes()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(expired); errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expired media not swept")
+}
+
+func TestNewStateKeepsLimits(t *testing.T) {
+	s := &Service{}
+	config := testConfig()
+	config.IPRateLimit = conf.RateLimit{Count: 10, Per: time.Minute}
+	prev, err := s.newState(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.UserAgent = "8bloat-reloaded"
+	st, err := s.newState(config, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.limits != prev.limits {
+		t.Error("limits started over, though the rates are the same")
+	}
+
+	config.IPRateLimit.Count = 20
+	st, err = s.newState(config, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.limits == prev.limits || st.limits.ip.rate.Count != 20 {
+		t.Error("limits kept, though the rates changed")
+	}
+}
+
+func TestFeedToken(t *testing.T) {
+	c := newSignedInClient(t)
+
+	c.post("/feed/token", nil).redirect(t, "POST /feed/token", "/settings")
+	token := c.session().Identity().FeedToken
+	link, err := c.s.state.Load().feeds.Get(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(token, link.Session) {
+		t.Errorf("feed token %q discloses the session ID", token)
+	}
+
+	feed := "/feed/timeline/home?token=" + url.QueryEscape(token)
+	if res := c.get(feed); res.Header.Get("Content-Type") != render.FeedContentType("") {
+		t.Fatalf("GET feed: status %d, %s", res.Code, res.Body)
+	}
+
+	c.post("/feed/token/revoke", nil).redirect(t, "POST /feed/token/revoke", "/settings")
+	if res := c.get(feed); res.Header.Get("Content-Type") == render.FeedContentType("") {
+		t.Error("feed still served after revoking its token")
+	}
+	if _, err := c.s.state.Load().feeds.Get(token); err == nil {
+		t.Error("revoked feed token still stored")
+	}
+	if _, err := c.getSession(); err != nil {
+		t.Error("revoking the feed token signed out")
+	}
+}
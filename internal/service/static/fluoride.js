@@ -125,6 +125,25 @@ function handleRetweetForm(id, f) {
 	}
 }
 
+function handleReactForm(id, f) {
+	f.onsubmit = function(event) {
+		var b = event.submitter;
+		if (!b || !b.formAction)
+			return;
+		event.preventDefault();
+
+		var body = "csrf_token=" + encodeURIComponent(csrfToken);
+		var contentType = "application/x-www-form-urlencoded";
+		var path = new URL(b.formAction).pathname;
+		http("POST", "/fluoride" + path, body, contentType, function(res, type) {
+			var details = f.parentNode;
+			if (details.tagName === "DETAILS")
+				details.open = false;
+			b.disabled = true;
+		});
+	}
+}
+
 function isInView(el) {
 	var ract = el.getBoundingClientRect();
 	if (ract.top > 0 && ract.bottom < window.innerHeight)
@@ -275,6 +294,10 @@ function onPaste(e) {
 	if (!e.clipboardData.files)
 		return;
 	var fp = document.querySelector("#post-file-picker")
+	if (!fp) {
+		pasteIntoSlots(e.clipboardData.files);
+		return;
+	}
 	var dt = new DataTransfer();
 	for (var i = 0; i < fp.files.length; i++) {
 		dt.items.add(fp.files[i]);
@@ -285,6 +308,18 @@ function onPaste(e) {
 	fp.files = dt.files;
 }
 
+function pasteIntoSlots(files) {
+	var slots = document.querySelectorAll(".post-form-attachment-file");
+	var j = 0;
+	for (var i = 0; i < slots.length && j < files.length; i++) {
+		if (slots[i].files.length > 0)
+			continue;
+		var dt = new DataTransfer();
+		dt.items.add(files[j++]);
+		slots[i].files = dt.files;
+	}
+}
+
 document.addEventListener("DOMContentLoaded", function() { 
 	checkCSRFToken();
 	checkAntiDopamineMode();
@@ -300,6 +335,10 @@ document.addEventListener("DOMContentLoaded", function() {
 		var retweetForm = s.querySelector(".status-retweet");
 		handleRetweetForm(id, retweetForm);
 
+		var reactForm = s.querySelector(".status-react-form");
+		if (reactForm)
+			handleReactForm(id, reactForm);
+
 		var replyToLink = s.querySelector(".status-reply-to-link");
 		handleReplyToLink(replyToLink);
 
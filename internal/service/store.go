@@ -0,0 +1,198 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"spiderden.org/8bloat/internal/conf"
+	"sync"
+	"time"
+)
+
+// SessionStore keeps sessions on the server, so the session cookie only
+// has to carry an opaque ID. Implementations must be safe for concurrent
+// use, and must return errInvalidSession for unknown or expired IDs.
+type SessionStore interface {
+	Get(id string) (*Session, error)
+	Put(id string, sess *Session) error
+	Delete(id string) error
+}
+
+func newStore(config conf.Configuration) (SessionStore, error) {
+	switch config.SessionStore {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "file":
+		return newFileStore(filepath.Join(config.DatabasePath, "sessions"))
+	default:
+		return nil, errors.New("unknown session store " + config.SessionStore)
+	}
+}
+
+type memoryEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// memoryStore keeps sessions in memory, they are lost on restart.
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	puts    int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]memoryEntry)}
+}
+
+func (m *memoryStore) Get(id string) (*Session, error) {
+	m.mu.Lock()
+	e, ok := m.entries[id]
+	m.mu.Unlock()
+
+	if !ok || time.Now().After(e.expires) {
+		return nil, errInvalidSession
+	}
+
+	// Sessions are stored encoded so that handlers never share one.
+	var sess Session
+	err := json.Unmarshal(e.data, &sess)
+	return &sess, err
+}
+
+func (m *memoryStore) Put(id string, sess *Session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[id] = memoryEntry{data: data, expires: time.Now().Add(sessionLifetime)}
+
+	// Sweep expired sessions every so often, so the map doesn't
+	// grow forever.
+	m.puts++
+	if m.puts%1024 == 0 {
+		now := time.Now()
+		for k, v := range m.entries {
+			if now.After(v.expires) {
+				delete(m.entries, k)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryStore) Delete(id string) error {
+	m.mu.Lock()
+	delete(m.entries, id)
+	m.mu.Unlock()
+	return nil
+}
+
+// fileStore keeps each session in its own file under dir. The modification
+// time of the file is used to expire it.
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	f := &fileStore{dir: dir}
+	f.sweep()
+	return f, nil
+}
+
+// path hashes the ID, so it can never escape the directory.
+func (f *fileStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:]))
+}
+
+func (f *fileStore) Get(id string) (*Session, error) {
+	p := f.path(id)
+
+	stat, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errInvalidSession
+	} else if err != nil {
+		return nil, err
+	}
+
+	if time.Since(stat.ModTime()) > sessionLifetime {
+		os.Remove(p)
+		return nil, errInvalidSession
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var sess Session
+	err = json.Unmarshal(data, &sess)
+	return &sess, err
+}
+
+func (f *fileStore) Put(id string, sess *Session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(f.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path(id))
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+func (f *fileStore) Delete(id string) error {
+	err := os.Remove(f.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *fileStore) sweep() {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return
+	}
+
+	for _, v := range entries {
+		info, err := v.Info()
+		if err != nil || v.IsDir() {
+			continue
+		}
+
+		if time.Since(info.ModTime()) > sessionLifetime {
+			os.Remove(filepath.Join(f.dir, v.Name()))
+		}
+	}
+}
@@ -2,46 +2,79 @@ package service
 
 import (
 	"context"
-	"encoding/base64"
+	"crypto/subtle"
 	"encoding/json"
 	"github.com/bwmarrin/snowflake"
+	"log/slog"
 	"net/http"
 	"spiderden.org/8bloat/internal/conf"
 	"strings"
 	"time"
 
 	"spiderden.org/8bloat/internal/render"
+	"spiderden.org/8bloat/internal/upstream"
 
 	"spiderden.org/masta"
 )
 
 type Transaction struct {
 	*masta.Client
-	h       *http.Client
-	R       *http.Request
-	Conf    *conf.Configuration
-	Session *Session
-	Rctx    *render.Context
-	sfnode  *snowflake.Node
-	Ctx     context.Context
-	W       http.ResponseWriter
-	Vars    map[string]string
-	Qry     map[string]string
+	Up       *upstream.Client
+	Caps     *upstream.Caps
+	h        *http.Client
+	stats    *upstreamStats
+	R        *http.Request
+	Conf     *conf.Configuration
+	Session  *Session
+	Rctx     *render.Context
+	sfnode   *snowflake.Node
+	sealer   *sealer
+	store    SessionStore
+	apps     AppStore
+	feeds    FeedStore
+	caps     *capsCache
+	apiCache *apiCache
+	quotes   *upstream.Quotes
+	filtered *upstream.Filtered
+	proxy    *mediaProxy
+	log      *slog.Logger
+	metrics  *metrics
+	limits   *limits
+	Ctx      context.Context
+	W        http.ResponseWriter
+	Vars     map[string]string
+	Qry      map[string]string
+}
+
+// sessionRef is what's sealed into the session cookie, the session itself
+// lives in the store.
+type sessionRef struct {
+	ID string `json:"id"`
 }
 
 func (c *Transaction) setSession(sess *Session) error {
-	var sb strings.Builder
-	bw := base64.NewEncoder(base64.URLEncoding, &sb)
-	err := json.NewEncoder(bw).Encode(sess)
-	bw.Close()
+	if sess.id == "" {
+		id, err := NewRandID(32)
+		if err != nil {
+			return err
+		}
+		sess.id = id
+	}
+
+	err := c.store.Put(sess.id, sess)
 	if err != nil {
 		return err
 	}
-	http.SetCookie(c.W, &http.Cookie{
-		Name:    "session",
-		Value:   sb.String(),
-		Expires: time.Now().Add(365 * 24 * time.Hour),
-	})
+
+	return c.setSessionCookie(sess.id)
+}
+
+func (c *Transaction) setSessionCookie(id string) error {
+	value, err := c.sealer.seal("session", sessionRef{ID: id})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(c.W, c.sessionCookie(value, time.Now().Add(sessionLifetime)))
 	return nil
 }
 
@@ -50,18 +83,44 @@ func (c *Transaction) getSession() (sess *Session, err error) {
 	if cookie == nil {
 		return nil, errInvalidSession
 	}
-	br := base64.NewDecoder(base64.URLEncoding, strings.NewReader(cookie.Value))
-	err = json.NewDecoder(br).Decode(&sess)
+
+	var ref sessionRef
+	stale, err := c.sealer.open("session", cookie.Value, &ref)
+	if err != nil || ref.ID == "" {
+		return nil, errInvalidSession
+	}
+
+	sess, err = c.store.Get(ref.ID)
+	if err != nil {
+		return nil, err
+	}
+	sess.id = ref.ID
+
+	if stale {
+		err = c.setSessionCookie(ref.ID)
+	}
 	return
 }
 
 func (c *Transaction) unsetSession() {
-	c.RevokeToken(c.Ctx)
-	http.SetCookie(c.W, &http.Cookie{
-		Name:    "session",
-		Value:   "",
-		Expires: time.Now(),
-	})
+	if c.Session != nil && c.Session.id != "" {
+		if err := c.store.Delete(c.Session.id); err != nil {
+			c.log.Warn("error deleting session", "err", err)
+		}
+	}
+	http.SetCookie(c.W, c.sessionCookie("", time.Now()))
+}
+
+func (c *Transaction) sessionCookie(value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     "session",
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   strings.HasPrefix(c.Conf.ClientWebsite, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
 }
 
 func (c *Transaction) writeJson(data interface{}) error {
@@ -93,12 +152,18 @@ func (t *Transaction) authenticate(am authMode) (err error) {
 		}
 		t.Rctx = &render.Context{
 			CSRFToken: t.Session.CSRFToken,
-			UserID:    t.Session.UserID,
+			UserID:    t.Session.UserID(),
 			Referrer:  ref,
 			Settings:  t.Session.Settings,
+			Quotes:    t.quotes,
+			Filtered:  t.filtered,
 		}
 	}()
 
+	if ok, retry := t.limits.ip.allow(t.clientIP()); !ok {
+		return rateLimited(retry)
+	}
+
 	sess, err := t.getSession()
 	if err != nil {
 		if am == authAnon {
@@ -115,16 +180,16 @@ func (t *Transaction) authenticate(am authMode) (err error) {
 		return
 	}
 
-	t.Session = sess
-	t.Client = masta.NewClient(&masta.Config{
-		Server:       "https://" + t.Session.Instance,
-		ClientID:     t.Session.ClientID,
-		ClientSecret: t.Session.ClientSecret,
-		AccessToken:  t.Session.AccessToken,
-	})
+	if ok, retry := t.limits.session.allow(t.Session.id); !ok {
+		return rateLimited(retry)
+	}
 
-	t.Client.UserAgent = t.Conf.UserAgent
-	t.Client.Client = *t.h
+	ident := t.Session.Identity()
+	if ident == nil {
+		return errInvalidSession
+	}
+
+	t.useIdentity(ident)
 
 	if am != authSessCSRF {
 		return
@@ -137,7 +202,90 @@ func (t *Transaction) authenticate(am authMode) (err error) {
 	return
 }
 
-func newSession(t *Transaction, instance string) (rurl string, sess *Session, err error) {
+// authenticateFeed authenticates with the feed token in the query, since
+// feed readers can't send the session cookie. The token is opaque, the
+// feed store links it to the session and identity it was issued for, so
+// that it can be revoked without signing out.
+func (t *Transaction) authenticateFeed() error {
+	token := t.Qry["token"]
+	if token == "" {
+		return errInvalidSession
+	}
+
+	link, err := t.feeds.Get(token)
+	if err != nil {
+		return err
+	}
+
+	sess, err := t.store.Get(link.Session)
+	if err != nil {
+		return err
+	}
+	sess.id = link.Session
+
+	ident := sess.identity(link.Identity)
+	if ident == nil || ident.FeedToken == "" ||
+		subtle.ConstantTimeCompare([]byte(ident.FeedToken), []byte(token)) != 1 {
+		return errInvalidSession
+	}
+
+	t.Session = sess
+	t.useIdentity(ident)
+	return nil
+}
+
+// feedToken returns the feed token of the active identity, if it has one.
+func (t *Transaction) feedToken() string {
+	ident := t.Session.Identity()
+	if ident == nil {
+		return ""
+	}
+	return ident.FeedToken
+}
+
+// revokeFeedToken removes the feed token of ident, if it has one. The
+// session still has to be saved.
+func (t *Transaction) revokeFeedToken(ident *Identity) {
+	if ident == nil || ident.FeedToken == "" {
+		return
+	}
+	if err := t.feeds.Delete(ident.FeedToken); err != nil {
+		t.log.Warn("error deleting feed token", "err", err)
+	}
+	ident.FeedToken = ""
+}
+
+// clientIP returns the address of the client, for rate limiting.
+func (t *Transaction) clientIP() string {
+	return clientIP(t.R, t.Conf.RealIPHeader, t.Conf.RealIPTrustedHops)
+}
+
+// useIdentity sets the clients used for API calls to those of the
+// identity, along with what its instance supports.
+func (t *Transaction) useIdentity(ident *Identity) {
+	t.Client = t.clientFor(ident)
+	t.Up = upstream.New(t.Client)
+	t.Caps = t.caps.get(t.Ctx, ident.Instance, t.Up)
+}
+
+func (t *Transaction) clientFor(ident *Identity) *masta.Client {
+	client := masta.NewClient(&masta.Config{
+		Server:       "https://" + ident.Instance,
+		ClientID:     ident.ClientID,
+		ClientSecret: ident.ClientSecret,
+		AccessToken:  ident.AccessToken,
+	})
+
+	client.UserAgent = t.Conf.UserAgent
+	client.Client = *t.h
+	client.Client.Transport = upstream.Inspect(t.h.Transport, t.quotes, t.filtered)
+	return client
+}
+
+// newIdentity registers an app with the instance, and returns the URL the
+// user should be sent to for authorisation. The identity is only usable
+// after the OAuth callback has filled in the access token.
+func newIdentity(t *Transaction, instance string) (rurl string, ident *Identity, err error) {
 	var instanceURL string
 	if strings.HasPrefix(instance, "https://") {
 		instanceURL = instance
@@ -146,44 +294,167 @@ func newSession(t *Transaction, instance string) (rurl string, sess *Session, er
 		instanceURL = "https://" + instance
 	}
 
-	csrf, err := NewCSRFToken()
-	if err != nil {
+	if single, ok := t.Conf.SingleInstance(); (!ok || instance != single) && !instanceAllowed(t.Conf, instance) {
+		err = errInstanceNotAllowed
 		return
 	}
 
-	app, err := masta.RegisterApp(t.Ctx, &masta.AppConfig{
-		Client:       *t.h,
-		Server:       instanceURL,
-		ClientName:   t.Conf.ClientName,
-		Scopes:       t.Conf.ClientScope,
-		Website:      t.Conf.ClientWebsite,
-		RedirectURIs: t.Conf.ClientWebsite + "/oauth_callback",
-	})
+	// Sign ins call the instance on behalf of whoever asks, which is
+	// what would be abused to spam instances.
+	if ok, retry := t.limits.signin.allow(t.clientIP()); !ok {
+		err = rateLimited(retry)
+		return
+	}
+
+	app, err := t.app(instance, instanceURL)
 	if err != nil {
 		return
 	}
-	sess = &Session{
+
+	ident = &Identity{
+		ID:           t.sfnode.Generate().String(),
 		Instance:     instance,
 		ClientID:     app.ClientID,
 		ClientSecret: app.ClientSecret,
-		CSRFToken:    csrf,
-		Settings:     *render.NewSettings(),
 	}
 
-	rurl = app.AuthURI
+	rurl = authURL(t.Conf, instanceURL, app)
 	return
 }
 
+// beginSignin starts the OAuth flow for another identity. The current
+// session is kept, so that signing in adds an account instead of
+// replacing it.
+func beginSignin(t *Transaction, instance string) error {
+	url, ident, err := newIdentity(t, instance)
+	if err != nil {
+		return err
+	}
+
+	sess := t.Session
+	if sess == nil {
+		sess = &Session{Settings: *render.NewSettings()}
+	}
+
+	if sess.CSRFToken == "" {
+		sess.CSRFToken, err = NewCSRFToken()
+		if err != nil {
+			return err
+		}
+	}
+
+	sess.Pending = ident
+
+	err = t.setSession(sess)
+	if err != nil {
+		return err
+	}
+
+	t.redirect(url)
+	return nil
+}
+
+// removeIdentity revokes the identity's token and drops it from the
+// session. If it was the active one, the next identity becomes active,
+// and the session is removed entirely once none are left.
+func (t *Transaction) removeIdentity(id string) error {
+	ident := t.Session.identity(id)
+	if ident == nil {
+		return errInvalidArgument
+	}
+
+	t.clientFor(ident).RevokeToken(t.Ctx)
+	t.revokeFeedToken(ident)
+
+	idents := t.Session.Identities[:0]
+	for _, v := range t.Session.Identities {
+		if v.ID != id {
+			idents = append(idents, v)
+		}
+	}
+	t.Session.Identities = idents
+
+	if len(idents) == 0 {
+		t.unsetSession()
+		return nil
+	}
+
+	if t.Session.Active == id {
+		t.Session.Active = idents[0].ID
+	}
+
+	return t.setSession(t.Session)
+}
+
 type Session struct {
-	UserID       string          `json:"uid,omitempty"`
-	Instance     string          `json:"ins,omitempty"`
-	ClientID     string          `json:"cid,omitempty"`
-	ClientSecret string          `json:"cs,omitempty"`
-	AccessToken  string          `json:"at,omitempty"`
-	CSRFToken    string          `json:"csrf,omitempty"`
-	Settings     render.Settings `json:"sett,omitempty"`
+	id string
+
+	Identities []*Identity     `json:"ids,omitempty"`
+	Active     string          `json:"act,omitempty"`
+	Pending    *Identity       `json:"pend,omitempty"`
+	CSRFToken  string          `json:"csrf,omitempty"`
+	Settings   render.Settings `json:"sett,omitempty"`
+}
+
+// Identity is an account the user has signed in to.
+type Identity struct {
+	ID           string `json:"id"`
+	UserID       string `json:"uid,omitempty"`
+	Acct         string `json:"acct,omitempty"`
+	Instance     string `json:"ins,omitempty"`
+	ClientID     string `json:"cid,omitempty"`
+	ClientSecret string `json:"cs,omitempty"`
+	AccessToken  string `json:"at,omitempty"`
+	FeedToken    string `json:"ft,omitempty"`
+
+	Drafts  []*Draft  `json:"drafts,omitempty"`
+	Uploads []*Upload `json:"ups,omitempty"`
+}
+
+// Identity returns the active identity, or nil if there is none.
+func (s *Session) Identity() *Identity {
+	return s.identity(s.Active)
+}
+
+func (s *Session) identity(id string) *Identity {
+	for _, v := range s.Identities {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// domain returns the domain of the identity's account, the one that
+// accounts given without a domain are on.
+func (i *Identity) domain() string {
+	if _, domain, ok := strings.Cut(i.Acct, "@"); ok {
+		return domain
+	}
+	return i.Instance
+}
+
+func (s *Session) accounts() []render.AccountData {
+	accounts := make([]render.AccountData, len(s.Identities))
+	for i, v := range s.Identities {
+		accounts[i] = render.AccountData{
+			ID:       v.ID,
+			Acct:     v.Acct,
+			Instance: v.Instance,
+			Active:   v.ID == s.Active,
+		}
+	}
+	return accounts
+}
+
+func (s *Session) UserID() string {
+	if ident := s.Identity(); ident != nil {
+		return ident.UserID
+	}
+	return ""
 }
 
-func (s Session) IsLoggedIn() bool {
-	return len(s.AccessToken) > 0
+func (s *Session) IsLoggedIn() bool {
+	ident := s.Identity()
+	return ident != nil && len(ident.AccessToken) > 0
 }
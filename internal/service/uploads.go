@@ -0,0 +1,222 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"spiderden.org/8bloat/internal/upstream"
+)
+
+// uploadLifetime is how long uploaded attachments are remembered, so that
+// retrying a failed post doesn't upload them again. Instances remove
+// attachments that aren't posted on their own after a day or so.
+const uploadLifetime = 6 * time.Hour
+
+// Upload is an attachment that was uploaded but may not be posted yet.
+// Files are recognised by their hash when the post form is sent again.
+type Upload struct {
+	MediaID     string    `json:"mid"`
+	Hash        string    `json:"hash"`
+	Description string    `json:"desc,omitempty"`
+	Focus       string    `json:"focus,omitempty"`
+	Uploaded    time.Time `json:"at"`
+}
+
+type attachment struct {
+	file   *multipart.FileHeader
+	params upstream.MediaParams
+}
+
+// attachmentsFromForm reads the files of the post form. Files picked
+// together under attachments have no description, each numbered slot has
+// its own file, description and focal point.
+func (t *Transaction) attachmentsFromForm() ([]attachment, error) {
+	var atts []attachment
+	for _, f := range t.R.MultipartForm.File["attachments"] {
+		atts = append(atts, attachment{file: f})
+	}
+
+	for i := 0; i < t.Caps.MaxMediaAttachments; i++ {
+		n := strconv.Itoa(i)
+		files := t.R.MultipartForm.File["attachment_"+n]
+		if len(files) == 0 {
+			continue
+		}
+
+		focus := strings.TrimSpace(t.R.FormValue("focus_" + n))
+		if focus != "" && !validFocus(focus) {
+			return nil, errInvalidArgument
+		}
+
+		atts = append(atts, attachment{
+			file: files[0],
+			params: upstream.MediaParams{
+				Description: t.R.FormValue("alt_text_" + n),
+				Focus:       focus,
+			},
+		})
+	}
+
+	return atts, nil
+}
+
+// validFocus checks a focal point is "x,y" with both between -1 and 1.
+func validFocus(focus string) bool {
+	x, y, ok := strings.Cut(focus, ",")
+	if !ok {
+		return false
+	}
+
+	for _, v := range []string{x, y} {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || f < -1 || f > 1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// upload uploads the attachments and appends their IDs to mediaIDs. Files
+// that were already uploaded by an earlier attempt are reused. On error,
+// the IDs of the attachments that did upload are still returned, so they
+// can be kept in the draft.
+func (t *Transaction) upload(mediaIDs []string, atts []attachment) ([]string, error) {
+	if len(atts) == 0 {
+		return mediaIDs, nil
+	}
+
+	ident := t.Session.Identity()
+	t.expireUploads()
+
+	defer func() {
+		if err := t.setSession(t.Session); err != nil {
+			t.log.Warn("error saving uploads", "err", err)
+		}
+	}()
+
+	for _, a := range atts {
+		id, err := t.uploadOne(ident, mediaIDs, a)
+		if err != nil {
+			return mediaIDs, err
+		}
+		mediaIDs = append(mediaIDs, id)
+	}
+
+	return mediaIDs, nil
+}
+
+func (t *Transaction) uploadOne(ident *Identity, mediaIDs []string, a attachment) (string, error) {
+	f, err := a.file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	if u := findUpload(ident, hash, mediaIDs); u != nil {
+		if u.Description != a.params.Description || u.Focus != a.params.Focus {
+			if err = t.Up.UpdateMedia(t.Ctx, u.MediaID, a.params); err != nil {
+				return "", err
+			}
+			u.Description = a.params.Description
+			u.Focus = a.params.Focus
+		}
+		return u.MediaID, nil
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	m, err := t.Up.UploadMedia(t.Ctx, a.file.Filename, f, a.params)
+	if err != nil {
+		return "", err
+	}
+
+	ident.Uploads = append(ident.Uploads, &Upload{
+		MediaID:     m.ID,
+		Hash:        hash,
+		Description: a.params.Description,
+		Focus:       a.params.Focus,
+		Uploaded:    time.Now(),
+	})
+
+	return m.ID, nil
+}
+
+// findUpload finds an earlier upload of the same file, that isn't already
+// part of this post.
+func findUpload(ident *Identity, hash string, mediaIDs []string) *Upload {
+	for _, u := range ident.Uploads {
+		if u.Hash == hash && !slices.Contains(mediaIDs, u.MediaID) {
+			return u
+		}
+	}
+	return nil
+}
+
+// expireUploads forgets old uploads, and deletes them from the instance
+// unless a draft still uses them.
+func (t *Transaction) expireUploads() {
+	ident := t.Session.Identity()
+
+	uploads := ident.Uploads[:0]
+	for _, u := range ident.Uploads {
+		if time.Since(u.Uploaded) < uploadLifetime {
+			uploads = append(uploads, u)
+			continue
+		}
+
+		if !draftsUse(ident, u.MediaID) {
+			if err := t.Up.DeleteMedia(t.Ctx, u.MediaID); err != nil {
+				t.log.Warn("error deleting upload", "media_id", u.MediaID, "err", err)
+			}
+		}
+	}
+	ident.Uploads = uploads
+}
+
+func draftsUse(ident *Identity, mediaID string) bool {
+	for _, d := range ident.Drafts {
+		if slices.Contains(d.MediaIDs, mediaID) {
+			return true
+		}
+	}
+	return false
+}
+
+// postedUploads forgets the uploads that were posted.
+func (t *Transaction) postedUploads(mediaIDs []string) {
+	ident := t.Session.Identity()
+	if len(ident.Uploads) == 0 {
+		return
+	}
+
+	uploads := ident.Uploads[:0]
+	for _, u := range ident.Uploads {
+		if !slices.Contains(mediaIDs, u.MediaID) {
+			uploads = append(uploads, u)
+		}
+	}
+
+	if len(uploads) == len(ident.Uploads) {
+		return
+	}
+	ident.Uploads = uploads
+
+	if err := t.setSession(t.Session); err != nil {
+		t.log.Warn("error saving uploads", "err", err)
+	}
+}
@@ -0,0 +1,42 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// VerifyApp checks that the instance still accepts the client ID and
+// secret of the client, by asking for a token with only them. ok is false
+// if the instance rejected them, err is only set if it couldn't tell.
+func (c *Client) VerifyApp(ctx context.Context, scopes string) (ok bool, err error) {
+	params := url.Values{}
+	params.Set("grant_type", "client_credentials")
+	params.Set("client_id", c.mc.Config.ClientID)
+	params.Set("client_secret", c.mc.Config.ClientSecret)
+	if scopes != "" {
+		params.Set("scope", scopes)
+	}
+
+	var res struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = c.do(ctx, http.MethodPost, "/oauth/token", params, &res)
+
+	var ue *Error
+	if errors.As(err, &ue) && (ue.Code == http.StatusUnauthorized || ue.Message == "invalid_client") {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// The token isn't needed, so don't leave it lying around.
+	params = url.Values{}
+	params.Set("client_id", c.mc.Config.ClientID)
+	params.Set("client_secret", c.mc.Config.ClientSecret)
+	params.Set("token", res.AccessToken)
+	c.do(ctx, http.MethodPost, "/oauth/revoke", params, nil)
+
+	return true, nil
+}
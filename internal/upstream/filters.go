@@ -0,0 +1,184 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"spiderden.org/masta"
+)
+
+// What is done with the statuses a filter matches.
+const (
+	FilterWarn = "warn"
+	FilterHide = "hide"
+)
+
+// FilterContexts are where filters can apply.
+var FilterContexts = []string{"home", "notifications", "public", "thread", "account"}
+
+// Filter is a group of keywords filtered in some contexts, as Mastodon 4.0
+// has them. Filters of older instances have one keyword each.
+type Filter struct {
+	ID        string          `json:"id"`
+	Title     string          `json:"title"`
+	Context   []string        `json:"context"`
+	ExpiresAt *time.Time      `json:"expires_at"`
+	Action    string          `json:"filter_action"`
+	Keywords  []FilterKeyword `json:"keywords"`
+}
+
+type FilterKeyword struct {
+	ID        string `json:"id,omitempty"`
+	Keyword   string `json:"keyword"`
+	WholeWord bool   `json:"whole_word"`
+}
+
+// Applies reports whether the filter is in effect in the context.
+func (f *Filter) Applies(context string) bool {
+	if f.ExpiresAt != nil && !f.ExpiresAt.IsZero() && f.ExpiresAt.Before(time.Now()) {
+		return false
+	}
+	return slices.Contains(f.Context, context)
+}
+
+// FilterV1 converts a filter of the old API, which only has one keyword,
+// and hides what it matches only when it's irreversible. Otherwise it's
+// up to clients, so it's taken as a warning.
+func FilterV1(f *masta.Filter) *Filter {
+	action := FilterWarn
+	if f.Irreversible {
+		action = FilterHide
+	}
+
+	filter := &Filter{
+		ID:       string(f.ID),
+		Title:    f.Phrase,
+		Context:  f.Context,
+		Action:   action,
+		Keywords: []FilterKeyword{{Keyword: f.Phrase, WholeWord: f.WholeWord}},
+	}
+	if !f.ExpiresAt.IsZero() {
+		filter.ExpiresAt = &f.ExpiresAt
+	}
+	return filter
+}
+
+func (c *Client) GetFilters(ctx context.Context) ([]*Filter, error) {
+	var filters []*Filter
+	err := c.do(ctx, http.MethodGet, "/api/v2/filters", nil, &filters)
+	if err != nil {
+		return nil, err
+	}
+	return filters, nil
+}
+
+// CreateFilter creates the filter with its keywords. It expires after
+// expiresIn, or never if it's zero.
+func (c *Client) CreateFilter(ctx context.Context, f *Filter, expiresIn time.Duration) (*Filter, error) {
+	params := url.Values{}
+	params.Set("title", f.Title)
+	params.Set("filter_action", f.Action)
+	for _, v := range f.Context {
+		params.Add("context[]", v)
+	}
+	if expiresIn > 0 {
+		params.Set("expires_in", strconv.Itoa(int(expiresIn.Seconds())))
+	}
+	for i, v := range f.Keywords {
+		key := "keywords_attributes[" + strconv.Itoa(i) + "]"
+		params.Set(key+"[keyword]", v.Keyword)
+		params.Set(key+"[whole_word]", strconv.FormatBool(v.WholeWord))
+	}
+
+	var filter Filter
+	err := c.do(ctx, http.MethodPost, "/api/v2/filters", params, &filter)
+	if err != nil {
+		return nil, err
+	}
+	return &filter, nil
+}
+
+func (c *Client) DeleteFilter(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v2/filters/"+url.PathEscape(id), nil, nil)
+}
+
+// Filtered collects the filters matched by the statuses of API responses,
+// which instances with filters v2 send along with each status, since
+// masta.Status has no field for them. It is filled in by the transport
+// returned by Inspect, and is safe for concurrent use.
+type Filtered struct {
+	mu      sync.Mutex
+	filters map[masta.ID][]*Filter
+}
+
+func NewFiltered() *Filtered {
+	return &Filtered{filters: make(map[masta.ID][]*Filter)}
+}
+
+// Get returns the filters matched by the status with the given ID, if it
+// was seen in a response.
+func (f *Filtered) Get(id masta.ID) []*Filter {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.filters[id]
+}
+
+// Statuses always have filtered, but it's only worth decoding when a
+// filter matched.
+var filterActionKey = []byte(`"filter_action"`)
+
+// collect walks a decoded response and records the filters matched by
+// every status in it.
+func (f *Filtered) collect(v interface{}) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			f.collect(e)
+		}
+	case map[string]interface{}:
+		if id, ok := statusID(v); ok {
+			f.record(id, v)
+		}
+		for _, e := range v {
+			f.collect(e)
+		}
+	}
+}
+
+func (f *Filtered) record(id masta.ID, v map[string]interface{}) {
+	results, ok := v["filtered"].([]interface{})
+	if !ok || len(results) == 0 {
+		return
+	}
+
+	var filters []*Filter
+	for _, r := range results {
+		rv, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		data, err := json.Marshal(rv["filter"])
+		if err != nil {
+			continue
+		}
+		var filter Filter
+		if json.Unmarshal(data, &filter) == nil && filter.ID != "" {
+			filters = append(filters, &filter)
+		}
+	}
+
+	f.mu.Lock()
+	f.filters[id] = filters
+	f.mu.Unlock()
+}
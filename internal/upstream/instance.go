@@ -0,0 +1,272 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	Mastodon   = "mastodon"
+	Pleroma    = "pleroma"
+	Akkoma     = "akkoma"
+	GoToSocial = "gotosocial"
+)
+
+// Caps describes what an instance supports, so that actions it doesn't
+// have can be hidden instead of failing.
+type Caps struct {
+	Software string
+	Version  string
+
+	SupportsReactions      bool
+	SupportsContentTypes   bool
+	SupportsRemoteTimeline bool
+	SupportsMarkRead       bool
+	SupportsSubscriptions  bool
+	SupportsIncludeTypes   bool
+	SupportsQuotes         bool
+	SupportsFollowTags     bool
+	SupportsFiltersV2      bool
+
+	// QuoteParam is the name of the parameter that sets the status a new
+	// status quotes.
+	QuoteParam string
+
+	// ContentTypes lists the post formats the instance accepts, if it
+	// says so.
+	ContentTypes        []string
+	MaxChars            int
+	MaxMediaAttachments int
+}
+
+// DefaultCaps is assumed when probing fails. It only has what every
+// backend supports.
+func DefaultCaps() *Caps {
+	return &Caps{MaxChars: 500, MaxMediaAttachments: 4}
+}
+
+// SupportsContentType reports whether posts can be made in the format.
+func (c *Caps) SupportsContentType(ct string) bool {
+	if !c.SupportsContentTypes {
+		return false
+	}
+	if len(c.ContentTypes) == 0 {
+		return true
+	}
+	for _, v := range c.ContentTypes {
+		if v == ct {
+			return true
+		}
+	}
+	return false
+}
+
+type instance struct {
+	Version       string `json:"version"`
+	MaxTootChars  int    `json:"max_toot_chars"`
+	Configuration struct {
+		Statuses struct {
+			MaxCharacters       int      `json:"max_characters"`
+			MaxMediaAttachments int      `json:"max_media_attachments"`
+			SupportedMimeTypes  []string `json:"supported_mime_types"`
+		} `json:"statuses"`
+	} `json:"configuration"`
+	Pleroma *struct {
+		Metadata struct {
+			Features    []string `json:"features"`
+			PostFormats []string `json:"post_formats"`
+		} `json:"metadata"`
+	} `json:"pleroma"`
+}
+
+type nodeInfoLinks struct {
+	Links []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+type nodeInfo struct {
+	Software struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"software"`
+}
+
+// Probe asks the instance what it is and what it supports. Nodeinfo is
+// optional, if it can't be read, the software is guessed from the
+// instance's version string.
+func (c *Client) Probe(ctx context.Context) (*Caps, error) {
+	var inst instance
+	err := c.do(ctx, http.MethodGet, "/api/v1/instance", nil, &inst)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := DefaultCaps()
+	caps.Version = inst.Version
+
+	if ni, err := c.nodeInfo(ctx); err == nil {
+		caps.Software = strings.ToLower(ni.Software.Name)
+		caps.Version = ni.Software.Version
+	} else {
+		caps.Software = guessSoftware(&inst)
+	}
+
+	if inst.Configuration.Statuses.MaxCharacters > 0 {
+		caps.MaxChars = inst.Configuration.Statuses.MaxCharacters
+	} else if inst.MaxTootChars > 0 {
+		caps.MaxChars = inst.MaxTootChars
+	}
+
+	if n := inst.Configuration.Statuses.MaxMediaAttachments; n > 0 {
+		caps.MaxMediaAttachments = n
+	}
+
+	if inst.Pleroma != nil {
+		md := inst.Pleroma.Metadata
+		caps.SupportsRemoteTimeline = true
+		caps.SupportsMarkRead = true
+		caps.SupportsSubscriptions = true
+		caps.SupportsIncludeTypes = true
+		caps.SupportsReactions = hasFeature(md.Features, "pleroma_emoji_reactions")
+		if hasFeature(md.Features, "quote_posting") {
+			caps.SupportsQuotes = true
+			caps.QuoteParam = "quote_id"
+		}
+		caps.SupportsContentTypes = len(md.PostFormats) > 0
+		caps.ContentTypes = md.PostFormats
+	} else if types := inst.Configuration.Statuses.SupportedMimeTypes; len(types) > 1 {
+		// GoToSocial and some Mastodon forks list the formats they
+		// accept here.
+		caps.SupportsContentTypes = true
+		caps.ContentTypes = types
+	}
+
+	// Followed hashtags came with Mastodon 4.0 and Pleroma 2.6, Akkoma
+	// has them too.
+	switch caps.Software {
+	case Mastodon:
+		caps.SupportsFollowTags = versionAtLeast(caps.Version, 4, 0)
+	case Pleroma:
+		caps.SupportsFollowTags = versionAtLeast(caps.Version, 2, 6)
+	case Akkoma:
+		caps.SupportsFollowTags = true
+	}
+
+	// Filters with keyword groups and actions came with Mastodon 4.0,
+	// GoToSocial has them since 0.16.
+	switch caps.Software {
+	case Mastodon:
+		caps.SupportsFiltersV2 = versionAtLeast(caps.Version, 4, 0)
+	case GoToSocial:
+		caps.SupportsFiltersV2 = versionAtLeast(caps.Version, 0, 16)
+	}
+
+	// Mastodon has quotes since 4.5.
+	if caps.Software == Mastodon && versionAtLeast(caps.Version, 4, 5) {
+		caps.SupportsQuotes = true
+		caps.QuoteParam = "quoted_status_id"
+	}
+
+	return caps, nil
+}
+
+var errNodeInfoHost = errors.New("nodeinfo is not on the instance")
+
+func (c *Client) nodeInfo(ctx context.Context) (*nodeInfo, error) {
+	var links nodeInfoLinks
+	err := c.do(ctx, http.MethodGet, "/.well-known/nodeinfo", nil, &links)
+	if err != nil {
+		return nil, err
+	}
+
+	// Take the newest 2.x schema.
+	var rel, href string
+	for _, v := range links.Links {
+		if strings.HasPrefix(v.Rel, "http://nodeinfo.diaspora.software/ns/schema/2.") && v.Rel > rel {
+			rel, href = v.Rel, v.Href
+		}
+	}
+
+	if href == "" {
+		return nil, &Error{Code: http.StatusNotFound}
+	}
+
+	// The document is only fetched from the instance itself, it could
+	// point anywhere, internal hosts included.
+	u, err := url.Parse(href)
+	if err != nil {
+		return nil, err
+	}
+	server, err := url.Parse(c.mc.Config.Server)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != server.Scheme || u.Host != server.Host || u.User != nil {
+		return nil, errNodeInfoHost
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ni nodeInfo
+	err = c.send(req, &ni)
+	if err != nil {
+		return nil, err
+	}
+	return &ni, nil
+}
+
+func guessSoftware(inst *instance) string {
+	switch {
+	case strings.Contains(inst.Version, "Akkoma"):
+		return Akkoma
+	case strings.Contains(inst.Version, "Pleroma"):
+		return Pleroma
+	case strings.Contains(inst.Version, "git-"):
+		return GoToSocial
+	default:
+		return Mastodon
+	}
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, v := range features {
+		if v == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// versionAtLeast reports whether the version string starts with a version
+// that is at least major.minor, such as 4.5.0+glitch.
+func versionAtLeast(version string, major int, minor int) bool {
+	var v [2]int
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+
+	for i := range v {
+		digits := strings.IndexFunc(parts[i], func(r rune) bool { return r < '0' || r > '9' })
+		if digits == -1 {
+			digits = len(parts[i])
+		}
+
+		n, err := strconv.Atoi(parts[i][:digits])
+		if err != nil {
+			return false
+		}
+		v[i] = n
+	}
+
+	return v[0] > major || (v[0] == major && v[1] >= minor)
+}
@@ -0,0 +1,45 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"spiderden.org/masta"
+)
+
+// GetListAccounts returns a page of the accounts in the list. masta only
+// fetches all of them at once.
+func (c *Client) GetListAccounts(ctx context.Context, id string, pg *masta.Pagination) ([]*masta.Account, error) {
+	var accounts []*masta.Account
+	err := c.doPaged(ctx, http.MethodGet, "/api/v1/lists/"+url.PathEscape(id)+"/accounts", nil, &accounts, pg)
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// maxListPages is how many pages of accounts GetAllListAccounts fetches,
+// of up to 80 accounts each.
+const maxListPages = 10
+
+// GetAllListAccounts returns the accounts in the list, following its
+// pages. Longer lists are cut short after maxListPages.
+func (c *Client) GetAllListAccounts(ctx context.Context, id string) ([]*masta.Account, error) {
+	var all []*masta.Account
+	var maxID masta.ID
+	for i := 0; i < maxListPages; i++ {
+		pg := &masta.Pagination{MaxID: maxID, Limit: 80}
+		accounts, err := c.GetListAccounts(ctx, id, pg)
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, accounts...)
+		if len(accounts) == 0 || pg.MaxID == "" || pg.MaxID == maxID {
+			break
+		}
+		maxID = pg.MaxID
+	}
+	return all, nil
+}
@@ -0,0 +1,102 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"spiderden.org/masta"
+)
+
+// MediaParams are the attributes of an attachment that masta can't set
+// when uploading it.
+type MediaParams struct {
+	Description string
+	// Focus is the focal point, as "x,y" with both between -1 and 1.
+	Focus string
+}
+
+func (p *MediaParams) values() url.Values {
+	params := url.Values{}
+	if p.Description != "" {
+		params.Set("description", p.Description)
+	}
+	if p.Focus != "" {
+		params.Set("focus", p.Focus)
+	}
+	return params
+}
+
+// UploadMedia uploads the file as an attachment. The file is streamed,
+// rather than read into memory first.
+func (c *Client) UploadMedia(ctx context.Context, name string, file io.Reader, p MediaParams) (*masta.Attachment, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		err := writeMedia(mw, name, file, p.values())
+		pw.CloseWithError(err)
+	}()
+
+	u := strings.TrimSuffix(c.mc.Config.Server, "/") + "/api/v2/media"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if c.mc.Config.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.mc.Config.AccessToken)
+	}
+
+	var a masta.Attachment
+	err = c.send(req, &a)
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func writeMedia(mw *multipart.Writer, name string, file io.Reader, params url.Values) error {
+	for k, v := range params {
+		if err := mw.WriteField(k, v[0]); err != nil {
+			return err
+		}
+	}
+
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(part, file); err != nil {
+		return err
+	}
+
+	return mw.Close()
+}
+
+// UpdateMedia sets the description and focal point of an attachment that
+// isn't attached to a status yet. Unlike when uploading, an empty
+// description is sent, to remove the one the attachment has, and an empty
+// focal point is the centre.
+func (c *Client) UpdateMedia(ctx context.Context, id string, p MediaParams) error {
+	params := p.values()
+	params.Set("description", p.Description)
+	if p.Focus == "" {
+		params.Set("focus", "0,0")
+	}
+	return c.do(ctx, http.MethodPut, "/api/v1/media/"+url.PathEscape(id), params, nil)
+}
+
+// DeleteMedia deletes an attachment that isn't attached to a status.
+// Older instances don't support it, they remove such attachments on
+// their own after a while.
+func (c *Client) DeleteMedia(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/media/"+url.PathEscape(id), nil, nil)
+}
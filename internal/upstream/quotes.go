@@ -0,0 +1,165 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"spiderden.org/masta"
+)
+
+// Quotes collects the statuses quoted by the statuses of API responses,
+// since masta.Status has no field for them. It is filled in by the
+// transport returned by Inspect, and is safe for concurrent use.
+type Quotes struct {
+	mu       sync.Mutex
+	statuses map[masta.ID]*masta.Status
+	ids      map[masta.ID]masta.ID
+}
+
+func NewQuotes() *Quotes {
+	return &Quotes{
+		statuses: make(map[masta.ID]*masta.Status),
+		ids:      make(map[masta.ID]masta.ID),
+	}
+}
+
+// Get returns the status quoted by the status with the given ID, if it
+// was seen in a response.
+func (q *Quotes) Get(id masta.ID) *masta.Status {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.statuses[id]
+}
+
+// ID returns the ID of the status quoted by the status with the given ID.
+// It is known even when the quoted status itself isn't included.
+func (q *Quotes) ID(id masta.ID) masta.ID {
+	if q == nil {
+		return ""
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.ids[id]
+}
+
+// Most responses have no quotes at all, so don't bother decoding those
+// twice.
+var quoteKey = []byte(`"quote`)
+
+// collect walks a decoded response and records the quote of every status
+// in it, including those of quoted and reblogged statuses.
+func (q *Quotes) collect(v interface{}) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			q.collect(e)
+		}
+	case map[string]interface{}:
+		if id, ok := statusID(v); ok {
+			q.record(id, v)
+		}
+		for _, e := range v {
+			q.collect(e)
+		}
+	}
+}
+
+func statusID(v map[string]interface{}) (masta.ID, bool) {
+	id, ok := v["id"].(string)
+	if !ok {
+		return "", false
+	}
+	_, hasContent := v["content"]
+	_, hasAccount := v["account"]
+	return masta.ID(id), hasContent && hasAccount
+}
+
+// record finds the quote of the status. Pleroma and Akkoma put the quoted
+// status in quote, or in pleroma.quote on older versions, and its ID in
+// quote_id. Mastodon wraps it in a quote object along with its state, and
+// only gives the ID for quotes nested further.
+func (q *Quotes) record(id masta.ID, v map[string]interface{}) {
+	var quoted map[string]interface{}
+	var quotedID string
+
+	switch qv := v["quote"].(type) {
+	case map[string]interface{}:
+		if s, ok := qv["quoted_status"].(map[string]interface{}); ok {
+			quoted = s
+		} else if _, ok := statusID(qv); ok {
+			quoted = qv
+		}
+		if s, ok := qv["quoted_status_id"].(string); ok {
+			quotedID = s
+		}
+	}
+
+	if p, ok := v["pleroma"].(map[string]interface{}); ok {
+		if quoted == nil {
+			quoted, _ = p["quote"].(map[string]interface{})
+		}
+		if quotedID == "" {
+			quotedID, _ = p["quote_id"].(string)
+		}
+	}
+
+	if quotedID == "" {
+		quotedID, _ = v["quote_id"].(string)
+	}
+
+	var status *masta.Status
+	if quoted != nil {
+		data, err := json.Marshal(quoted)
+		if err == nil {
+			var s masta.Status
+			if json.Unmarshal(data, &s) == nil {
+				status = &s
+				quotedID = string(s.ID)
+			}
+		}
+	}
+
+	if quotedID == "" {
+		return
+	}
+
+	q.mu.Lock()
+	q.ids[id] = masta.ID(quotedID)
+	if status != nil {
+		q.statuses[id] = status
+	}
+	q.mu.Unlock()
+}
+
+// QuoteParams returns the parameter that makes a new status quote the one
+// with the given ID, as the instance names it.
+func (c *Caps) QuoteParams(id string) url.Values {
+	if id == "" || c.QuoteParam == "" {
+		return nil
+	}
+	return url.Values{c.QuoteParam: {id}}
+}
+
+// PostStatus posts the toot along with the extra parameters, for those
+// masta doesn't know about.
+func (c *Client) PostStatus(ctx context.Context, toot *masta.Toot, extra url.Values) (*masta.Status, error) {
+	params := tootParams(toot)
+	for k, v := range extra {
+		params[k] = v
+	}
+
+	var s masta.Status
+	err := c.do(ctx, http.MethodPost, "/api/v1/statuses", params, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,48 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"spiderden.org/masta"
+)
+
+// Reaction is an emoji reaction on a status, Pleroma and Akkoma only.
+type Reaction struct {
+	Name     string           `json:"name"`
+	Count    int              `json:"count"`
+	Me       bool             `json:"me"`
+	URL      string           `json:"url,omitempty"`
+	Accounts []*masta.Account `json:"accounts,omitempty"`
+}
+
+type reactedStatus struct {
+	Pleroma struct {
+		EmojiReactions []*Reaction `json:"emoji_reactions"`
+	} `json:"pleroma"`
+}
+
+func reactionsPath(id string) string {
+	return "/api/v1/pleroma/statuses/" + url.PathEscape(id) + "/reactions"
+}
+
+func (c *Client) GetReactions(ctx context.Context, id string) ([]*Reaction, error) {
+	var r []*Reaction
+	err := c.do(ctx, http.MethodGet, reactionsPath(id), nil, &r)
+	return r, err
+}
+
+// React adds a reaction, emoji is either a unicode emoji or the shortcode
+// of a custom one. It returns the reactions of the status afterwards.
+func (c *Client) React(ctx context.Context, id string, emoji string) ([]*Reaction, error) {
+	var s reactedStatus
+	err := c.do(ctx, http.MethodPut, reactionsPath(id)+"/"+url.PathEscape(emoji), nil, &s)
+	return s.Pleroma.EmojiReactions, err
+}
+
+func (c *Client) Unreact(ctx context.Context, id string, emoji string) ([]*Reaction, error) {
+	var s reactedStatus
+	err := c.do(ctx, http.MethodDelete, reactionsPath(id)+"/"+url.PathEscape(emoji), nil, &s)
+	return s.Pleroma.EmojiReactions, err
+}
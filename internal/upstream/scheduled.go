@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"spiderden.org/masta"
+)
+
+type ScheduledStatus struct {
+	ID               string             `json:"id"`
+	ScheduledAt      time.Time          `json:"scheduled_at"`
+	Params           ScheduledParams    `json:"params"`
+	MediaAttachments []masta.Attachment `json:"media_attachments"`
+}
+
+type ScheduledParams struct {
+	Text        string `json:"text"`
+	SpoilerText string `json:"spoiler_text"`
+	Visibility  string `json:"visibility"`
+	Sensitive   bool   `json:"sensitive"`
+	InReplyToID string `json:"in_reply_to_id"`
+}
+
+// PostScheduledStatus schedules the toot to be published at the given
+// time. Instances refuse times that are less than five minutes away.
+func (c *Client) PostScheduledStatus(ctx context.Context, toot *masta.Toot, at time.Time, extra url.Values) (*ScheduledStatus, error) {
+	params := tootParams(toot)
+	for k, v := range extra {
+		params[k] = v
+	}
+	params.Set("scheduled_at", at.UTC().Format(time.RFC3339))
+
+	var s ScheduledStatus
+	err := c.do(ctx, http.MethodPost, "/api/v1/statuses", params, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (c *Client) GetScheduledStatuses(ctx context.Context) ([]*ScheduledStatus, error) {
+	var s []*ScheduledStatus
+	err := c.do(ctx, http.MethodGet, "/api/v1/scheduled_statuses", url.Values{"limit": {"40"}}, &s)
+	return s, err
+}
+
+func (c *Client) RescheduleStatus(ctx context.Context, id string, at time.Time) (*ScheduledStatus, error) {
+	params := url.Values{}
+	params.Set("scheduled_at", at.UTC().Format(time.RFC3339))
+
+	var s ScheduledStatus
+	err := c.do(ctx, http.MethodPut, "/api/v1/scheduled_statuses/"+url.PathEscape(id), params, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (c *Client) CancelScheduledStatus(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/scheduled_statuses/"+url.PathEscape(id), nil, nil)
+}
@@ -0,0 +1,76 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"spiderden.org/masta"
+)
+
+// Tag is a hashtag, along with whether the user follows it.
+type Tag struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Following bool   `json:"following"`
+}
+
+// Which parts of a hashtag timeline to show.
+const (
+	TagAll    = ""
+	TagLocal  = "local"
+	TagRemote = "remote"
+)
+
+// GetTagTimeline returns the statuses with the hashtag. only is TagAll,
+// TagLocal or TagRemote. Like masta's timelines, pg is replaced with the
+// range in the Link header, for paging.
+func (c *Client) GetTagTimeline(ctx context.Context, name string, only string, pg *masta.Pagination) ([]*masta.Status, error) {
+	params := url.Values{}
+	switch only {
+	case TagLocal:
+		params.Set("local", "true")
+	case TagRemote:
+		params.Set("remote", "true")
+	}
+
+	var statuses []*masta.Status
+	err := c.doPaged(ctx, http.MethodGet, "/api/v1/timelines/tag/"+url.PathEscape(name), params, &statuses, pg)
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// GetTag returns the hashtag, so that the timeline can show whether it's
+// followed.
+func (c *Client) GetTag(ctx context.Context, name string) (*Tag, error) {
+	var tag Tag
+	err := c.do(ctx, http.MethodGet, "/api/v1/tags/"+url.PathEscape(name), nil, &tag)
+	if err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+func (c *Client) FollowTag(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/tags/"+url.PathEscape(name)+"/follow", nil, nil)
+}
+
+func (c *Client) UnfollowTag(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/tags/"+url.PathEscape(name)+"/unfollow", nil, nil)
+}
+
+// GetFollowedTags returns the hashtags the user follows, as many as the
+// instance gives at once.
+func (c *Client) GetFollowedTags(ctx context.Context) ([]*Tag, error) {
+	params := url.Values{}
+	params.Set("limit", "200")
+
+	var tags []*Tag
+	err := c.do(ctx, http.MethodGet, "/api/v1/followed_tags", params, &tags)
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
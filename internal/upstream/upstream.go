@@ -0,0 +1,245 @@
+// Package upstream calls the parts of the Mastodon and Pleroma APIs that
+// masta doesn't cover, using the server, token and HTTP client of a
+// masta.Client.
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"spiderden.org/masta"
+)
+
+type Client struct {
+	mc *masta.Client
+}
+
+func New(mc *masta.Client) *Client {
+	return &Client{mc: mc}
+}
+
+// Error is returned when the instance responds with an error status.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	s := "upstream: " + strconv.Itoa(e.Code) + " " + http.StatusText(e.Code)
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, params url.Values, res interface{}) error {
+	return c.doPaged(ctx, method, path, params, res, nil)
+}
+
+// doPaged is do for lists. The range in pg is sent and, like masta does,
+// pg is replaced with the one in the Link header of the response, if
+// there's one.
+func (c *Client) doPaged(ctx context.Context, method string, path string, params url.Values, res interface{}, pg *masta.Pagination) error {
+	if pg != nil {
+		if params == nil {
+			params = url.Values{}
+		}
+		setPagination(params, pg)
+	}
+
+	u := strings.TrimSuffix(c.mc.Config.Server, "/") + path
+
+	var body io.Reader
+	if method == http.MethodGet {
+		if len(params) > 0 {
+			u += "?" + params.Encode()
+		}
+	} else if params != nil {
+		body = strings.NewReader(params.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if c.mc.Config.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.mc.Config.AccessToken)
+	}
+
+	return c.sendPaged(req, res, pg)
+}
+
+func (c *Client) send(req *http.Request, res interface{}) error {
+	return c.sendPaged(req, res, nil)
+}
+
+func (c *Client) sendPaged(req *http.Request, res interface{}, pg *masta.Pagination) error {
+	if c.mc.UserAgent != "" {
+		req.Header.Set("User-Agent", c.mc.UserAgent)
+	}
+
+	resp, err := c.mc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &Error{Code: resp.StatusCode}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil {
+			e.Message = body.Error
+		}
+		return e
+	}
+
+	if pg != nil {
+		if lh := resp.Header.Get("Link"); lh != "" {
+			*pg = linkPagination(lh)
+		}
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func setPagination(params url.Values, pg *masta.Pagination) {
+	if pg.MaxID != "" {
+		params.Set("max_id", string(pg.MaxID))
+	}
+	if pg.SinceID != "" {
+		params.Set("since_id", string(pg.SinceID))
+	}
+	if pg.MinID != "" {
+		params.Set("min_id", string(pg.MinID))
+	}
+	if pg.Limit > 0 {
+		params.Set("limit", strconv.FormatInt(int64(pg.Limit), 10))
+	}
+}
+
+// linkPagination reads the range of the pages around a list from its
+// Link header, the max_id of the next page and the min_id and since_id of
+// the previous one.
+func linkPagination(header string) masta.Pagination {
+	var pg masta.Pagination
+	for _, link := range strings.Split(header, ",") {
+		target, params, _ := strings.Cut(link, ";")
+		target = strings.TrimSpace(target)
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+
+		u, err := url.Parse(target[1 : len(target)-1])
+		if err != nil {
+			continue
+		}
+		q := u.Query()
+
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if k != "rel" {
+				continue
+			}
+			switch strings.Trim(v, `"`) {
+			case "next":
+				pg.MaxID = q.Get("max_id")
+			case "prev":
+				pg.MinID = q.Get("min_id")
+				pg.SinceID = q.Get("since_id")
+			}
+		}
+	}
+	return pg
+}
+
+// Inspect wraps rt, so that quotes and filter results are collected from
+// the responses that go through it. Each response is decoded at most once,
+// for both. The response is left as it was, for masta to decode.
+func Inspect(rt http.RoundTripper, quotes *Quotes, filtered *Filtered) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &inspectTripper{underlying: rt, quotes: quotes, filtered: filtered}
+}
+
+// inspectTripper decodes the JSON responses with something of interest,
+// for what masta doesn't decode.
+type inspectTripper struct {
+	underlying http.RoundTripper
+	quotes     *Quotes
+	filtered   *Filtered
+}
+
+func (t *inspectTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.underlying.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusOK ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, err
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	quotes := t.quotes != nil && bytes.Contains(data, quoteKey)
+	filtered := t.filtered != nil && bytes.Contains(data, filterActionKey)
+	if !quotes && !filtered {
+		return resp, nil
+	}
+
+	var v interface{}
+	if json.Unmarshal(data, &v) != nil {
+		return resp, nil
+	}
+	if quotes {
+		t.quotes.collect(v)
+	}
+	if filtered {
+		t.filtered.collect(v)
+	}
+	return resp, nil
+}
+
+// tootParams mirrors the parameters masta sends for a toot.
+func tootParams(toot *masta.Toot) url.Values {
+	params := url.Values{}
+	params.Set("status", toot.Status)
+	if toot.InReplyToID != "" {
+		params.Set("in_reply_to_id", toot.InReplyToID)
+	}
+	for _, v := range toot.MediaIDs {
+		params.Add("media_ids[]", v)
+	}
+	if toot.Visibility != "" {
+		params.Set("visibility", toot.Visibility)
+	}
+	if toot.Sensitive {
+		params.Set("sensitive", "true")
+	}
+	if toot.SpoilerText != "" {
+		params.Set("spoiler_text", toot.SpoilerText)
+	}
+	if toot.ContentType != "" {
+		params.Set("content_type", toot.ContentType)
+	}
+	return params
+}